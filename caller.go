@@ -0,0 +1,65 @@
+package gormxray
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// callerFrames caches, per program counter, the formatted "file:line:func" entry of an application frame, or ""
+// for frames that callerChain skips. Queries are usually issued from a small set of call sites, so after warm-up
+// building a chain only costs the stack walk.
+var callerFrames sync.Map
+
+// callerChain returns up to depth "file:line:func" entries for the application frames that issued the query,
+// innermost first, skipping GORM, this plugin and the standard library.
+func callerChain(depth int) []string {
+	pcs := make([]uintptr, 64)
+	pcs = pcs[:runtime.Callers(2, pcs)]
+	chain := make([]string, 0, depth)
+	for _, pc := range pcs {
+		entry, ok := callerFrames.Load(pc)
+		if !ok {
+			entry = appFrame(pc)
+			callerFrames.Store(pc, entry)
+		}
+		if entry != "" {
+			chain = append(chain, entry.(string))
+			if len(chain) == depth {
+				break
+			}
+		}
+	}
+	return chain
+}
+
+// appFrame formats the frame at pc as "file:line:func", or returns "" if it belongs to GORM, this plugin or the
+// standard library.
+func appFrame(pc uintptr) string {
+	// Only the innermost function at pc is kept; frames inlined into it aren't expanded.
+	frame, _ := runtime.CallersFrames([]uintptr{pc}).Next()
+	if frame.File == "" || internalFrame(frame) || stdlibFunction(frame.Function) {
+		return ""
+	}
+	name := frame.Function
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	return fmt.Sprintf("%s:%d:%s", frame.File, frame.Line, name)
+}
+
+// stdlibFunction reports whether the fully qualified function name belongs to the standard library, whose import
+// paths, unlike module paths, have no dot in their first element.
+func stdlibFunction(function string) bool {
+	pkg := function
+	if i := strings.LastIndex(pkg, "/"); i >= 0 {
+		if j := strings.Index(pkg[i:], "."); j >= 0 {
+			pkg = pkg[:i+j]
+		}
+	} else if j := strings.Index(pkg, "."); j >= 0 {
+		pkg = pkg[:j]
+	}
+	first := strings.SplitN(pkg, "/", 2)[0]
+	return pkg != "main" && !strings.Contains(first, ".")
+}
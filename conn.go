@@ -0,0 +1,160 @@
+package gormxray
+
+import (
+	"database/sql"
+	"reflect"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+// maxCachedConns bounds the number of connections whose values are cached before the cache is reset.
+const maxCachedConns = 1024
+
+// connCache caches the result of a lookup query per connection pool. The key function returns the key a statement's
+// value is cached under and the connection to run the lookup on, or a nil connection if the lookup doesn't apply. A
+// nil key runs the lookup without caching its result.
+type connCache struct {
+	key func(tx *gorm.DB) (interface{}, gorm.ConnPool)
+
+	mu     sync.Mutex
+	values map[interface{}]string
+}
+
+// newConnCache returns a cache for per-connection values, keyed by the driver connection so that the transactions
+// run on one connection share a lookup. Only pinned connections (transactions and *sql.Conn) are supported, since a
+// query on a pooled *sql.DB may run on any connection.
+func newConnCache() *connCache {
+	return &connCache{
+		key: func(tx *gorm.DB) (interface{}, gorm.ConnPool) {
+			conn := pinnedConn(tx.Statement.ConnPool)
+			return physicalConn(conn), conn
+		},
+		values: make(map[interface{}]string),
+	}
+}
+
+// newServerCache returns a cache for values that are the same on every connection to the server, such as its
+// version. Values are keyed by the underlying *sql.DB, so that the transactions and sessions opened on it share
+// one lookup.
+func newServerCache() *connCache {
+	return &connCache{
+		key: func(tx *gorm.DB) (interface{}, gorm.ConnPool) {
+			pool := tx.Statement.ConnPool
+			if db, err := tx.DB(); err == nil {
+				return db, pool
+			}
+			return pool, pool
+		},
+		values: make(map[interface{}]string),
+	}
+}
+
+// lookup returns the cached value for the statement's connection, running query on it the first time the
+// connection is seen. It reports false for unsupported connections, an empty query or a failed lookup.
+func (c *connCache) lookup(tx *gorm.DB, query string) (string, bool) {
+	key, conn := c.key(tx)
+	if conn == nil || query == "" {
+		return "", false
+	}
+
+	if key != nil {
+		c.mu.Lock()
+		val, ok := c.values[key]
+		c.mu.Unlock()
+		if ok {
+			return val, true
+		}
+	}
+	if rowsOpen(tx) {
+		return "", false
+	}
+
+	var val string
+	if err := conn.QueryRowContext(tx.Statement.Context, query).Scan(&val); err != nil {
+		return "", false
+	}
+	if key == nil {
+		return val, true
+	}
+
+	c.mu.Lock()
+	if len(c.values) >= maxCachedConns {
+		c.values = make(map[interface{}]string)
+	}
+	c.values[key] = val
+	c.mu.Unlock()
+	return val, true
+}
+
+// physicalConn identifies the driver connection a pinned connection runs on, or returns nil if it can't be found.
+// *sql.Conn exposes it through Raw. *sql.Tx doesn't, so its unexported driver connection is read through
+// reflection, the way GORM reads the *sql.DB of a transaction.
+func physicalConn(conn gorm.ConnPool) interface{} {
+	switch c := conn.(type) {
+	case *sql.Conn:
+		var key interface{}
+		_ = c.Raw(func(driverConn interface{}) error {
+			if driverConn != nil && reflect.TypeOf(driverConn).Comparable() {
+				key = driverConn
+			}
+			return nil
+		})
+		return key
+	case *sql.Tx:
+		if dc := reflect.ValueOf(c).Elem().FieldByName("dc"); dc.IsValid() && dc.Kind() == reflect.Ptr && !dc.IsNil() {
+			return dc.UnsafePointer()
+		}
+	}
+	return nil
+}
+
+// engineVersionQuery returns the dialector-specific query for the server version, or an empty string if the engine
+// isn't supported.
+func engineVersionQuery(engine string) string {
+	switch engine {
+	case "postgres", "mysql":
+		return "SELECT version()"
+	case "sqlite":
+		return "SELECT sqlite_version()"
+	}
+	return ""
+}
+
+// connsOpened returns how many connections the statement's *sql.DB has opened so far, approximated from its stats
+// as the connections currently open plus those closed for being idle or too old. Connections closed after a driver
+// error aren't counted. It reports false for statements pinned to a connection, which can't open a new one.
+func connsOpened(tx *gorm.DB) (int64, bool) {
+	if pinnedConn(tx.Statement.ConnPool) != nil {
+		return 0, false
+	}
+	db, err := tx.DB()
+	if err != nil {
+		return 0, false
+	}
+	stats := db.Stats()
+	return int64(stats.OpenConnections) + stats.MaxIdleClosed + stats.MaxIdleTimeClosed + stats.MaxLifetimeClosed, true
+}
+
+// pinnedConn returns the connection pool if it is bound to a single physical connection.
+func pinnedConn(pool gorm.ConnPool) gorm.ConnPool {
+	switch conn := pool.(type) {
+	case *sql.Tx, *sql.Conn:
+		return conn
+	case *gorm.PreparedStmtTX:
+		return pinnedConn(conn.Tx)
+	}
+	return nil
+}
+
+// backendPIDQuery returns the dialector-specific query for the server-side connection identifier, or an empty
+// string if the engine doesn't have one.
+func backendPIDQuery(engine string) string {
+	switch engine {
+	case "postgres":
+		return "SELECT pg_backend_pid()"
+	case "mysql":
+		return "SELECT CONNECTION_ID()"
+	}
+	return ""
+}
@@ -0,0 +1,46 @@
+package gormxray
+
+import (
+	"context"
+	"database/sql/driver"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+)
+
+// connectTracingKey marks the statement contexts of plugins configured with WithInstrumentConnPool, per
+// WithInstanceKeyNamespace.
+type connectTracingKey struct {
+	namespace string
+}
+
+// InstrumentConnector wraps a driver.Connector so that dialing a new physical connection is recorded as a
+// "db.connect" subsegment. database/sql hands the query's context to Connect when the pool has to open a
+// connection, so the subsegment nests under the query that triggered it. Dials are only traced for queries run by
+// a plugin configured with WithInstrumentConnPool(true). Only WithInstanceKeyNamespace is read from opts; pass the
+// same namespace as the plugin's so the connector answers to that plugin only.
+//
+//	sqlDB := sql.OpenDB(gormxray.InstrumentConnector(connector))
+//	db, err := gorm.Open(postgres.New(postgres.Config{Conn: sqlDB}), &gorm.Config{})
+func InstrumentConnector(c driver.Connector, opts ...Option) driver.Connector {
+	cfg := &PluginConfig{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return &tracedConnector{Connector: c, key: connectTracingKey{cfg.InstanceKeyNamespace}}
+}
+
+// tracedConnector opens a subsegment around the wrapped connector's Connect.
+type tracedConnector struct {
+	driver.Connector
+	key connectTracingKey
+}
+
+func (c *tracedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	if ctx.Value(c.key) == nil || xray.GetSegment(ctx) == nil {
+		return c.Connector.Connect(ctx)
+	}
+	ctx, seg := xray.BeginSubsegment(ctx, "db.connect")
+	conn, err := c.Connector.Connect(ctx)
+	seg.Close(err)
+	return conn, err
+}
@@ -0,0 +1,51 @@
+package gormxray
+
+import (
+	"errors"
+	"reflect"
+	"regexp"
+
+	"gorm.io/gorm"
+)
+
+// Driver error messages reporting unique violations, with the violated index or columns as first group.
+var (
+	// MySQL: Error 1062 (23000): Duplicate entry 'alice' for key 'users.idx_name'
+	mysqlDuplicateRegex = regexp.MustCompile(`Duplicate entry '.*' for key '([^']+)'`)
+	// SQLite: UNIQUE constraint failed: users.name
+	sqliteUniqueRegex = regexp.MustCompile(`UNIQUE constraint failed: (.+)$`)
+)
+
+// uniqueViolationSQLState is the SQLSTATE code Postgres reports for unique violations.
+const uniqueViolationSQLState = "23505"
+
+// uniqueViolation reports whether err is a unique constraint violation and returns the name of the violated
+// constraint or index when the driver exposes it. SQLite only names the columns involved, e.g. "users.name".
+func uniqueViolation(err error) (string, bool) {
+	var stateErr sqlStateError
+	if errors.As(err, &stateErr) && stateErr.SQLState() == uniqueViolationSQLState {
+		return constraintField(stateErr), true
+	}
+	if m := mysqlDuplicateRegex.FindStringSubmatch(err.Error()); m != nil {
+		return m[1], true
+	}
+	if m := sqliteUniqueRegex.FindStringSubmatch(err.Error()); m != nil {
+		return m[1], true
+	}
+	return "", errors.Is(err, gorm.ErrDuplicatedKey)
+}
+
+// constraintField reads the constraint name from Postgres driver errors, which expose it as a field
+// (pgconn.PgError.ConstraintName, pq.Error.Constraint) rather than a method.
+func constraintField(err interface{}) string {
+	v := reflect.Indirect(reflect.ValueOf(err))
+	if v.Kind() != reflect.Struct {
+		return ""
+	}
+	for _, name := range []string{"ConstraintName", "Constraint"} {
+		if f := v.FieldByName(name); f.IsValid() && f.Kind() == reflect.String {
+			return f.String()
+		}
+	}
+	return ""
+}
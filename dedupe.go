@@ -0,0 +1,46 @@
+package gormxray
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+)
+
+// errorDeduper counts the errors recorded under each parent segment, so repeats of the same error, e.g. in a retry
+// loop or a preload cascade, are only recorded as a fault once.
+type errorDeduper struct {
+	mu   sync.Mutex
+	seen *parentStore[map[string]int]
+}
+
+func newErrorDeduper() *errorDeduper {
+	return &errorDeduper{seen: newParentStore[map[string]int]()}
+}
+
+// observe records err under parent and returns how many times the same error, by type and message, was recorded
+// under it before.
+func (d *errorDeduper) observe(parent *xray.Segment, err error) int {
+	key := fmt.Sprintf("%T: %v", err, err)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	errs, ok := d.seen.get(parent)
+	if !ok {
+		*errs = make(map[string]int)
+	}
+	count := (*errs)[key]
+	(*errs)[key] = count + 1
+	return count
+}
+
+// duplicateErrorCount returns how many times err was already recorded under the statement's parent, or 0 if duplicate
+// errors aren't suppressed.
+func (p *Plugin) duplicateErrorCount(st *statementState, err error) int {
+	parent := st.trackedParent()
+	if p.duplicateErrors == nil || parent == nil {
+		return 0
+	}
+	return p.duplicateErrors.observe(parent, err)
+}
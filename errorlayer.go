@@ -0,0 +1,97 @@
+package gormxray
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"reflect"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// gormErrors are the errors GORM raises in its own layer, before or instead of talking to the driver. The errors
+// GORM translates from driver errors (gorm.ErrDuplicatedKey etc.) are deliberately left out.
+var gormErrors = []error{
+	gorm.ErrInvalidTransaction,
+	gorm.ErrNotImplemented,
+	gorm.ErrMissingWhereClause,
+	gorm.ErrUnsupportedRelation,
+	gorm.ErrPrimaryKeyRequired,
+	gorm.ErrModelValueRequired,
+	gorm.ErrModelAccessibleFieldsRequired,
+	gorm.ErrSubQueryRequired,
+	gorm.ErrInvalidData,
+	gorm.ErrUnsupportedDriver,
+	gorm.ErrRegistered,
+	gorm.ErrInvalidField,
+	gorm.ErrEmptySlice,
+	gorm.ErrDryRunModeUnsupported,
+	gorm.ErrInvalidDB,
+	gorm.ErrInvalidValue,
+	gorm.ErrInvalidValueOfLength,
+	gorm.ErrPreloadNotAllowed,
+	schema.ErrUnsupportedDataType,
+}
+
+// driverErrors are the errors database/sql and drivers report through well-known sentinels.
+var driverErrors = []error{
+	driver.ErrBadConn,
+	sql.ErrConnDone,
+	sql.ErrTxDone,
+	gorm.ErrDuplicatedKey,
+	gorm.ErrForeignKeyViolated,
+	gorm.ErrCheckConstraintViolated,
+}
+
+// driverPackages are the import path prefixes of the database drivers whose error types are recognized.
+var driverPackages = []string{
+	"github.com/mattn/go-sqlite3",
+	"github.com/glebarez/go-sqlite",
+	"modernc.org/sqlite",
+	"github.com/jackc/pgx",
+	"github.com/lib/pq",
+	"github.com/go-sql-driver/mysql",
+	"github.com/microsoft/go-mssqldb",
+	"github.com/denisenkom/go-mssqldb",
+	"github.com/ClickHouse/clickhouse-go",
+}
+
+// errorLayer classifies err as raised by GORM itself ("gorm"), by the database driver ("driver") or neither
+// ("unknown"). Driver errors are recognized by the known sentinels, a SQLSTATE code, or a concrete type declared in
+// one of driverPackages (e.g. *mysql.MySQLError, *pgconn.PgError, sqlite3.Error); errors of drivers missing from the
+// list are reported as "unknown" rather than guessed. A canceled or expired context is reported as "context": it
+// surfaces from GORM and the driver alike, so attributing it to either would misplace a caller-side timeout.
+func errorLayer(err error) string {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return "context"
+	}
+	for _, target := range gormErrors {
+		if errors.Is(err, target) {
+			return "gorm"
+		}
+	}
+	for _, target := range driverErrors {
+		if errors.Is(err, target) {
+			return "driver"
+		}
+	}
+	var stateErr sqlStateError
+	if errors.As(err, &stateErr) {
+		return "driver"
+	}
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		t := reflect.TypeOf(e)
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		for _, pkg := range driverPackages {
+			if strings.HasPrefix(t.PkgPath(), pkg) {
+				return "driver"
+			}
+		}
+	}
+	return "unknown"
+}
@@ -0,0 +1,49 @@
+package gormxray
+
+import (
+	"sync"
+	"time"
+)
+
+// errorTypeWindow is the time window over which WithErrorAnnotationSampling bounds the distinct error messages
+// promoted to the db.error_type annotation.
+const errorTypeWindow = time.Minute
+
+// distinctWindow admits up to max distinct values per time window. Values already admitted in the current window
+// keep being admitted; the set starts over when the window elapses.
+type distinctWindow struct {
+	max    int
+	window time.Duration
+
+	mu    sync.Mutex
+	start time.Time
+	seen  map[string]struct{}
+}
+
+func newDistinctWindow(max int, window time.Duration) *distinctWindow {
+	return &distinctWindow{
+		max:    max,
+		window: window,
+		start:  time.Now(),
+		seen:   make(map[string]struct{}, max),
+	}
+}
+
+// allow reports whether value is one of the first max distinct values seen in the current window.
+func (w *distinctWindow) allow(value string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if now := time.Now(); now.Sub(w.start) >= w.window {
+		w.start = now
+		w.seen = make(map[string]struct{}, w.max)
+	}
+	if _, ok := w.seen[value]; ok {
+		return true
+	}
+	if len(w.seen) >= w.max {
+		return false
+	}
+	w.seen[value] = struct{}{}
+	return true
+}
@@ -0,0 +1,52 @@
+package gormxray
+
+import (
+	"time"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"gorm.io/gorm"
+)
+
+// QueryEvent describes a completed query, as passed to the WithQueryEventCallback callback.
+type QueryEvent struct {
+	// Operation is the lowercased SQL verb, e.g. "select".
+	Operation string
+	// Table is the statement's table, empty for raw queries GORM didn't resolve a table for.
+	Table string
+	// Query is the query as recorded on the subsegment, i.e. after vars exclusion and the query formatter.
+	Query string
+	// Duration is the time the query took.
+	Duration time.Duration
+	// RowsAffected is the number of rows affected, or -1 when unknown.
+	RowsAffected int64
+	// Err is the error the statement failed with, if any, including non-critical ones such as gorm.ErrRecordNotFound.
+	Err error
+	// Annotations are the annotations recorded on the query's subsegment.
+	Annotations map[string]interface{}
+}
+
+// emitQueryEvent passes the completed query to the query event callback. query is the query as recorded on seg.
+func (p *Plugin) emitQueryEvent(tx *gorm.DB, seg *xray.Segment, query string, dur time.Duration) {
+	event := QueryEvent{
+		Operation:    dbOperation(query),
+		Table:        tx.Statement.Table,
+		Query:        query,
+		Duration:     dur,
+		RowsAffected: -1,
+		Err:          tx.Error,
+	}
+	if rows, ok := rowsAffected(tx); ok {
+		event.RowsAffected = rows
+	}
+
+	seg.RLock()
+	if len(seg.Annotations) > 0 {
+		event.Annotations = make(map[string]interface{}, len(seg.Annotations))
+		for key, val := range seg.Annotations {
+			event.Annotations[key] = val
+		}
+	}
+	seg.RUnlock()
+
+	p.queryEventCallback(event)
+}
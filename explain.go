@@ -0,0 +1,128 @@
+package gormxray
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// postgresPlanRowsRegex extracts the estimated row count from a Postgres plan node, e.g.
+// "(cost=0.00..35.50 rows=2550 width=36)".
+var postgresPlanRowsRegex = regexp.MustCompile(`\brows=(\d+)`)
+
+// sqliteFullScanRegex matches a SQLite plan node that reads a whole table, e.g. "SCAN users" or, before SQLite
+// 3.36, "SCAN TABLE users". Scans of a covering index aren't table scans.
+var sqliteFullScanRegex = regexp.MustCompile(`^SCAN (TABLE )?\S+$`)
+
+// explainQuery returns the dialector-specific EXPLAIN statement for query, or an empty string if the engine isn't
+// supported or query is already an EXPLAIN. The plan is estimated only, the query itself is never executed again.
+func explainQuery(engine, query string) string {
+	if strings.HasPrefix(strings.ToUpper(strings.TrimSpace(query)), "EXPLAIN") {
+		return ""
+	}
+	switch engine {
+	case "postgres":
+		return "EXPLAIN " + query
+	case "sqlite":
+		return "EXPLAIN QUERY PLAN " + query
+	}
+	return ""
+}
+
+// explainPlan runs EXPLAIN for the statement and summarizes the plan as its node descriptions and, on Postgres, the
+// estimated row count of the top node. On SQLite, full_scan reports whether any node scans a whole table. The EXPLAIN goes straight to the connection pool, bypassing GORM's callbacks,
+// so it is never traced or explained itself. Statements whose rows are still open are skipped.
+func explainPlan(tx *gorm.DB) (map[string]interface{}, error) {
+	if rowsOpen(tx) {
+		return nil, nil
+	}
+	engine := tx.Dialector.Name()
+	query := explainQuery(engine, tx.Statement.SQL.String())
+	if query == "" {
+		return nil, nil
+	}
+
+	rows, err := tx.Statement.ConnPool.QueryContext(tx.Statement.Context, query, tx.Statement.Vars...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	values := make([]interface{}, len(columns))
+	for i := range values {
+		values[i] = new(sql.RawBytes)
+	}
+
+	var nodes []string
+	for rows.Next() {
+		if err := rows.Scan(values...); err != nil {
+			return nil, err
+		}
+		// Postgres returns a single "QUERY PLAN" column, SQLite the node description in its last column
+		detail := values[len(values)-1]
+		if engine == "postgres" {
+			detail = values[0]
+		}
+		nodes = append(nodes, strings.TrimSpace(string(*detail.(*sql.RawBytes))))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(nodes) == 0 {
+		return nil, nil
+	}
+
+	plan := map[string]interface{}{"nodes": nodes}
+	if engine == "postgres" {
+		if m := postgresPlanRowsRegex.FindStringSubmatch(nodes[0]); m != nil {
+			if rows, err := strconv.ParseInt(m[1], 10, 64); err == nil {
+				plan["estimated_rows"] = rows
+			}
+		}
+	}
+	if engine == "sqlite" {
+		fullScan := false
+		for _, node := range nodes {
+			if sqliteFullScanRegex.MatchString(node) {
+				fullScan = true
+				break
+			}
+		}
+		plan["full_scan"] = fullScan
+	}
+	return plan, nil
+}
+
+// rowsOpen reports whether the statement handed its rows to the caller (Row and Rows). The connection may then be
+// busy until the caller closes them, so no other query can be run on it.
+func rowsOpen(tx *gorm.DB) bool {
+	switch tx.Statement.Dest.(type) {
+	case *sql.Row, *sql.Rows:
+		return true
+	}
+	return false
+}
+
+// recordExplainPlan attaches the statement's plan summary as db.plan, or the reason it couldn't be obtained as
+// db.plan.error. Full table scans are also annotated as db.full_scan=true, to find missing indexes.
+func (p *Plugin) recordExplainPlan(tx *gorm.DB, st *statementState) {
+	plan, err := explainPlan(tx)
+	if err != nil {
+		st.subsegment.AddMetadata("db.plan.error", fmt.Sprintf("explain failed: %v", err))
+		return
+	}
+	if plan != nil {
+		p.addMetadata(st.subsegment, "db.plan", plan)
+		if fullScan, _ := plan["full_scan"].(bool); fullScan {
+			p.addAnnotation(st.subsegment, "db.full_scan", true)
+		}
+	}
+}
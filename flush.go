@@ -0,0 +1,45 @@
+package gormxray
+
+import (
+	"sync"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+)
+
+// segmentSet tracks the fallback segments the plugin opened and hasn't closed yet.
+type segmentSet struct {
+	mu       sync.Mutex
+	segments map[*xray.Segment]struct{}
+}
+
+func newSegmentSet() *segmentSet {
+	return &segmentSet{segments: make(map[*xray.Segment]struct{})}
+}
+
+func (s *segmentSet) add(seg *xray.Segment) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.segments[seg] = struct{}{}
+}
+
+// close closes seg, which emits it, unless it was already closed by closeAll.
+func (s *segmentSet) close(seg *xray.Segment) {
+	s.mu.Lock()
+	_, open := s.segments[seg]
+	delete(s.segments, seg)
+	s.mu.Unlock()
+	if open {
+		seg.Close(nil)
+	}
+}
+
+// closeAll closes every segment still open.
+func (s *segmentSet) closeAll() {
+	s.mu.Lock()
+	segments := s.segments
+	s.segments = make(map[*xray.Segment]struct{})
+	s.mu.Unlock()
+	for seg := range segments {
+		seg.Close(nil)
+	}
+}
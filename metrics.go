@@ -0,0 +1,26 @@
+package gormxray
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// MetricsSink receives a measurement for every statement the plugin traces, including those whose subsegment is
+// later discarded by sampling, e.g. to feed a latency histogram labeled by operation and table.
+type MetricsSink interface {
+	ObserveQuery(op, table string, dur time.Duration, err error)
+}
+
+// observeQuery reports the statement to the metrics sink, with its labels normalized by the configured
+// WithOperationMetricLabels function.
+func (p *Plugin) observeQuery(tx *gorm.DB, st *statementState) {
+	if p.metricsSink == nil {
+		return
+	}
+	op, table := dbOperation(tx.Statement.SQL.String()), tx.Statement.Table
+	if p.operationMetricLabels != nil {
+		op, table = p.operationMetricLabels(op, table)
+	}
+	p.metricsSink.ObserveQuery(op, table, st.queryDuration(), tx.Error)
+}
@@ -0,0 +1,64 @@
+package gormxray
+
+import (
+	"sync"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"gorm.io/gorm"
+)
+
+// nPlusOneDetector tracks runs of consecutive identical query fingerprints per parent segment.
+type nPlusOneDetector struct {
+	threshold int
+
+	mu   sync.Mutex
+	runs *parentStore[queryRun]
+}
+
+// queryRun is the current run of identical queries issued under a parent segment.
+type queryRun struct {
+	fingerprint string
+	count       int
+	reported    bool
+}
+
+func newNPlusOneDetector(threshold int) *nPlusOneDetector {
+	return &nPlusOneDetector{
+		threshold: threshold,
+		runs:      newParentStore[queryRun](),
+	}
+}
+
+// observe records a query fingerprint under parent and reports whether the run of identical queries has just
+// exceeded the threshold. Each run is reported at most once.
+func (d *nPlusOneDetector) observe(parent *xray.Segment, fingerprint string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	run, _ := d.runs.get(parent)
+	if run.fingerprint != fingerprint {
+		*run = queryRun{fingerprint: fingerprint}
+	}
+	run.count++
+
+	if run.count > d.threshold && !run.reported {
+		run.reported = true
+		return true
+	}
+	return false
+}
+
+// detectNPlusOne feeds the statement's fingerprint to the detector and annotates the parent segment once a run of
+// identical queries exceeds the threshold.
+func (p *Plugin) detectNPlusOne(tx *gorm.DB, st *statementState) {
+	parent := st.trackedParent()
+	if parent == nil {
+		return
+	}
+
+	fingerprint := queryFingerprint(tx.Statement.SQL.String())
+	if p.nPlusOne.observe(parent, fingerprint) {
+		p.addAnnotation(parent, "db.nplus1.detected", true)
+		p.addAnnotation(parent, "db.nplus1.query", fingerprint)
+	}
+}
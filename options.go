@@ -1,5 +1,12 @@
 package gormxray
 
+import (
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+)
+
 // Option is a configuration option for NewPlugin.
 type Option func(*PluginConfig)
 
@@ -16,3 +23,705 @@ func WithQueryFormatter(formatter func(string) string) Option {
 		pc.QueryFormatter = formatter
 	}
 }
+
+// WithInheritParentAnnotations copies the given annotation keys from the parent segment onto each subsegment.
+// Only annotations set on the parent before the query started are visible to the plugin.
+func WithInheritParentAnnotations(keys ...string) Option {
+	return func(pc *PluginConfig) {
+		pc.InheritParentAnnotations = keys
+	}
+}
+
+// WithCapturePlanCache records whether a prepared statement was reused (db.plan.cache = "hit"|"miss").
+// It only has an effect when GORM runs in PrepareStmt mode; otherwise the field is omitted.
+func WithCapturePlanCache(capture bool) Option {
+	return func(pc *PluginConfig) {
+		pc.CapturePlanCache = capture
+	}
+}
+
+// WithFinalMetadataFunc registers a function invoked at the very end of the after hook with the query duration
+// and final error. The returned entries are added as metadata, which allows deriving fields such as latency buckets.
+func WithFinalMetadataFunc(fn func(tx *gorm.DB, dur time.Duration, err error) map[string]interface{}) Option {
+	return func(pc *PluginConfig) {
+		pc.FinalMetadataFunc = fn
+	}
+}
+
+// WithCaptureTableAlias records the alias of the primary table (e.g. "u" in "FROM users AS u") as db.table.alias.
+func WithCaptureTableAlias(capture bool) Option {
+	return func(pc *PluginConfig) {
+		pc.CaptureTableAlias = capture
+	}
+}
+
+// WithErrorMatcher overrides how errors are compared against the non-critical error set (defaults to errors.Is).
+// This helps with drivers that return non-wrapped copies of errors such as io.EOF or sql.ErrNoRows.
+func WithErrorMatcher(matcher func(err, target error) bool) Option {
+	return func(pc *PluginConfig) {
+		if matcher != nil {
+			pc.ErrorMatcher = matcher
+		}
+	}
+}
+
+// WithQueryPreview records the first n characters of the query, collapsed onto a single line, as db.query.preview.
+// The full query is still recorded as db.query.
+func WithQueryPreview(n int) Option {
+	return func(pc *PluginConfig) {
+		pc.QueryPreviewLength = n
+	}
+}
+
+// WithDeadlinePressureRatio sets the db.deadline_pressure=true annotation when a query consumed at least the given
+// fraction (0-1) of the time remaining on its context deadline. Queries without a deadline are never flagged.
+func WithDeadlinePressureRatio(ratio float64) Option {
+	return func(pc *PluginConfig) {
+		pc.DeadlinePressureRatio = ratio
+	}
+}
+
+// WithDetectNPlusOne annotates the parent segment with db.nplus1.detected=true and db.nplus1.query once more than
+// threshold consecutive queries with the same fingerprint are issued under it, surfacing N+1 query patterns.
+func WithDetectNPlusOne(threshold int) Option {
+	return func(pc *PluginConfig) {
+		pc.NPlusOneThreshold = threshold
+	}
+}
+
+// WithCompactMetadata records the core query metadata (operation, table, rows_affected, duration_ms and query) as a
+// single "db" object instead of separate db.* keys.
+func WithCompactMetadata(compact bool) Option {
+	return func(pc *PluginConfig) {
+		pc.CompactMetadata = compact
+	}
+}
+
+// WithRecordSQLState records the driver's SQLSTATE code as the db.sqlstate annotation when a critical error is
+// recorded and the driver error exposes one through a SQLState() string method.
+func WithRecordSQLState(record bool) Option {
+	return func(pc *PluginConfig) {
+		pc.RecordSQLState = record
+	}
+}
+
+// WithFlattenPreloads records the sub-queries GORM issues for Preload as a db.preloads list on the parent query's
+// subsegment instead of creating nested subsegments for them.
+func WithFlattenPreloads(flatten bool) Option {
+	return func(pc *PluginConfig) {
+		pc.FlattenPreloads = flatten
+	}
+}
+
+// WithAnnotationValueSanitizer overrides how annotation values are coerced before being added to a subsegment.
+// By default, values X-Ray doesn't accept (maps, slices, structs, ...) are stringified with fmt.Sprint rather
+// than dropped.
+func WithAnnotationValueSanitizer(sanitizer func(interface{}) interface{}) Option {
+	return func(pc *PluginConfig) {
+		if sanitizer != nil {
+			pc.AnnotationValueSanitizer = sanitizer
+		}
+	}
+}
+
+// WithCaptureResultCount records how many rows a SELECT scanned into the destination as db.result.count: the
+// slice length for Find into a slice, or 0/1 for a single struct.
+func WithCaptureResultCount(capture bool) Option {
+	return func(pc *PluginConfig) {
+		pc.CaptureResultCount = capture
+	}
+}
+
+// WithStatementTimeoutMetadata records the effective statement timeout, i.e. the time remaining on the context
+// deadline when the query started, as db.statement_timeout_ms. Queries without a deadline omit the field.
+func WithStatementTimeoutMetadata(record bool) Option {
+	return func(pc *PluginConfig) {
+		pc.StatementTimeoutMetadata = record
+	}
+}
+
+// WithBaseContext sets a context whose values are visible to queries that run without a parent segment, such as
+// batch jobs outside a request. It is merged into the statement context when the fallback segment is created, so
+// static values like the job name or environment flow onto job-originated traces.
+func WithBaseContext(ctx context.Context) Option {
+	return func(pc *PluginConfig) {
+		pc.BaseContext = ctx
+	}
+}
+
+// WithQueryNormalizationForNames names each subsegment after the query fingerprint's operation and table (e.g.
+// "select users") instead of the generic GORM callback name, keeping names low-cardinality for aggregation.
+func WithQueryNormalizationForNames(normalize bool) Option {
+	return func(pc *PluginConfig) {
+		pc.NormalizeNames = normalize
+	}
+}
+
+// WithAnnotationAllowlist restricts the annotations emitted by the plugin to the given keys. Other annotations are
+// recorded as metadata instead, which keeps the number of indexed annotations under control.
+func WithAnnotationAllowlist(keys ...string) Option {
+	return func(pc *PluginConfig) {
+		pc.AnnotationAllowlist = keys
+	}
+}
+
+// WithMinDurationToRecord drops the subsegments of successful queries that completed faster than d, trimming trace
+// volume for trivial queries. Failed queries are always recorded.
+func WithMinDurationToRecord(d time.Duration) Option {
+	return func(pc *PluginConfig) {
+		pc.MinDurationToRecord = d
+	}
+}
+
+// WithNameTemplate names each subsegment by rendering template with the {op}, {table} and {engine} placeholders,
+// e.g. "db.{table}.{op}" yields "db.users.select". Queries for which a used placeholder is unknown keep the
+// generic name. The template takes precedence over WithQueryNormalizationForNames.
+func WithNameTemplate(template string) Option {
+	return func(pc *PluginConfig) {
+		pc.NameTemplate = template
+	}
+}
+
+// WithErrorSampling records only a sampled fraction (0-1) of critical errors as faults with AddError. The remaining
+// failed subsegments get db.error=true metadata instead, capping fault volume during error storms while keeping the
+// error rate visible. Defaults to 1 (every error is recorded).
+func WithErrorSampling(rate float64) Option {
+	return func(pc *PluginConfig) {
+		pc.ErrorSampleRate = rate
+	}
+}
+
+// WithCaptureBackendPID records the server-side connection identifier (pg_backend_pid() on Postgres, CONNECTION_ID()
+// on MySQL) as db.backend_pid, for correlating traces with database logs. The identifier is looked up with an extra
+// query the first time a connection is used by a pinned pool (such as a transaction) and cached for that connection
+// afterwards. Other engines, pooled queries, and Row/Rows statements whose connection is still busy omit the field.
+func WithCaptureBackendPID(capture bool) Option {
+	return func(pc *PluginConfig) {
+		pc.CaptureBackendPID = capture
+	}
+}
+
+// WithGroupByModel sets the searchable "model" annotation to the GORM schema name (e.g. "Order") when the
+// statement operates on a model, so traces can be grouped by aggregate.
+func WithGroupByModel(group bool) Option {
+	return func(pc *PluginConfig) {
+		pc.GroupByModel = group
+	}
+}
+
+// WithRateLimiter caps the number of subsegments created per second with a token bucket. Queries beyond the limit
+// run untraced and are counted in Stats().Dropped, protecting the X-Ray daemon during load spikes.
+func WithRateLimiter(perSecond int) Option {
+	return func(pc *PluginConfig) {
+		pc.RateLimitPerSecond = perSecond
+	}
+}
+
+// WithUppercaseOperationVerb additionally records the SQL verb in uppercase (e.g. "SELECT") as db.operation.verb,
+// for downstream tools that expect uppercase verbs. db.operation stays lowercase.
+func WithUppercaseOperationVerb(uppercase bool) Option {
+	return func(pc *PluginConfig) {
+		pc.UppercaseOperationVerb = uppercase
+	}
+}
+
+// WithCaptureOrderBy records the ORDER BY columns of a query (e.g. ["created_at desc"]) as db.order_by.
+func WithCaptureOrderBy(capture bool) Option {
+	return func(pc *PluginConfig) {
+		pc.CaptureOrderBy = capture
+	}
+}
+
+// WithCaptureLimit records the shape of a query's LIMIT/OFFSET clause with values masked (e.g. "LIMIT ? OFFSET ?")
+// as db.limit.
+func WithCaptureLimit(capture bool) Option {
+	return func(pc *PluginConfig) {
+		pc.CaptureLimit = capture
+	}
+}
+
+// WithEnabled sets whether tracing starts enabled (the default). It can be toggled later with Plugin.SetEnabled.
+func WithEnabled(enabled bool) Option {
+	return func(pc *PluginConfig) {
+		pc.Enabled = enabled
+	}
+}
+
+// WithInstrumentConnPool traces the dialing of new physical connections as "db.connect" subsegments. database/sql
+// gives no hook into an already opened pool, so the pool must be created from a connector wrapped with
+// InstrumentConnector and handed to the dialector.
+func WithInstrumentConnPool(instrument bool) Option {
+	return func(pc *PluginConfig) {
+		pc.InstrumentConnPool = instrument
+	}
+}
+
+// WithCaptureVarTypes records the Go types of the bound query parameters as db.vars.types, e.g.
+// "[int,string,time.Time]". Only the types are recorded, so this is safe to combine with WithExcludeQueryVars.
+func WithCaptureVarTypes(capture bool) Option {
+	return func(pc *PluginConfig) {
+		pc.CaptureVarTypes = capture
+	}
+}
+
+// WithDetailOnError records full detail for failed queries even when the plugin is otherwise configured to keep
+// subsegments minimal: the query is recorded with its vars despite WithExcludeQueryVars, and the application code
+// location that issued it is recorded as db.caller.
+func WithDetailOnError(detail bool) Option {
+	return func(pc *PluginConfig) {
+		pc.DetailOnError = detail
+	}
+}
+
+// WithVersionMetadata records the plugin and GORM versions as gormxray.version and gorm.version metadata on the
+// first subsegment of each parent segment, so traces can be tied to the code that produced them.
+func WithVersionMetadata(record bool) Option {
+	return func(pc *PluginConfig) {
+		pc.VersionMetadata = record
+	}
+}
+
+// subsegmentTypes are the values accepted by WithSubsegmentType. "subsegment" is deliberately missing: the SDK
+// treats a subsegment of that type as an orphan, emits it on its own and never releases its parent, so the parent
+// segment would never be sent.
+var subsegmentTypes = map[string]bool{
+	"sql": true,
+}
+
+// WithSubsegmentType sets the type field of every query subsegment, a hint used by some trace viewers. Only "sql"
+// is accepted; other values, including "subsegment", are ignored and the field is left unset.
+func WithSubsegmentType(typ string) Option {
+	return func(pc *PluginConfig) {
+		if subsegmentTypes[typ] {
+			pc.SubsegmentType = typ
+		}
+	}
+}
+
+// WithCacheStatusKey records db.cache="hit" or "miss" on every subsegment, for apps that layer a cache in front of
+// GORM. A query is a hit when the cache layer set key to true in the statement context or, for string keys, with
+// db.Set(key, true).
+func WithCacheStatusKey(key interface{}) Option {
+	return func(pc *PluginConfig) {
+		pc.CacheStatusKey = key
+	}
+}
+
+// WithSlowKeepFastSample always records queries that take at least threshold and keeps only a sampled fraction
+// (0-1) of faster ones, so slow queries stay visible while routine traffic is thinned out. Since the duration is only
+// known once the query finished, the subsegments of dropped queries are discarded after the fact. Failed queries are
+// always kept.
+func WithSlowKeepFastSample(threshold time.Duration, fastRate float64) Option {
+	return func(pc *PluginConfig) {
+		pc.SlowQueryThreshold = threshold
+		pc.FastQuerySampleRate = fastRate
+	}
+}
+
+// WithCaptureAffectedIDs records the primary key values targeted by UPDATE and DELETE statements as db.affected_ids,
+// for audit-style tracing of bulk mutations. Values are taken from primary key conditions in the WHERE clause and
+// limited to max; when more were targeted, the full count is recorded as db.affected_ids.total. With
+// WithExcludeQueryVars each value is recorded as "?".
+func WithCaptureAffectedIDs(max int) Option {
+	return func(pc *PluginConfig) {
+		pc.CaptureAffectedIDs = max
+	}
+}
+
+// WithTraceHeaderInjection passes the X-Ray trace header of each query subsegment to the database, so that
+// components such as RDS Proxy can link the database call to the trace. See TraceHeaderMode for the supported modes;
+// TraceHeaderComment works with every dialector.
+func WithTraceHeaderInjection(mode TraceHeaderMode) Option {
+	return func(pc *PluginConfig) {
+		pc.TraceHeaderInjection = mode
+	}
+}
+
+// WithSelfProfiling records the time spent in the plugin's own hooks for each statement, excluding the query itself,
+// as db.instrumentation_overhead_us. Use it to verify the cost of tracing in production.
+func WithSelfProfiling(profile bool) Option {
+	return func(pc *PluginConfig) {
+		pc.SelfProfiling = profile
+	}
+}
+
+// WithFailFastOnFormatterError validates the query formatter when the plugin is registered: it is run against a
+// sample query and db.Use returns an error if it panics, instead of the formatter failing on the first query.
+func WithFailFastOnFormatterError(failFast bool) Option {
+	return func(pc *PluginConfig) {
+		pc.FailFastOnFormatterError = failFast
+	}
+}
+
+// WithCaptureConstraintErrors annotates unique violations with db.error_kind="unique_violation" and records the
+// violated constraint or index as db.constraint when the driver reports it (Postgres and MySQL name the constraint,
+// SQLite only the columns).
+func WithCaptureConstraintErrors(capture bool) Option {
+	return func(pc *PluginConfig) {
+		pc.CaptureConstraintErrors = capture
+	}
+}
+
+// WithSubsegmentPool recycles the per-statement state handed from the before to the after hook through a sync.Pool,
+// saving its allocation on every query. The state is detached from the statement, reset and returned to the pool
+// once the after hook is done with it.
+func WithSubsegmentPool(pool bool) Option {
+	return func(pc *PluginConfig) {
+		pc.SubsegmentPool = pool
+	}
+}
+
+// WithSampledVars excludes query vars from db.query except on a sampled fraction (0-1) of queries, which are recorded
+// with their values interpolated and flagged with db.vars.sampled=true. This limits the exposure of sensitive values
+// while occasionally providing full detail for debugging.
+func WithSampledVars(rate float64) Option {
+	return func(pc *PluginConfig) {
+		pc.ExcludeQueryVars = true
+		pc.SampledVarsRate = rate
+	}
+}
+
+// WithCaptureGORMError annotates failed queries with db.error_layer set to "gorm" when the error was raised by GORM
+// itself (validation, clause building), "driver" when it came from the database driver (syntax, constraints,
+// connections), "context" when the query's context was canceled or timed out, or "unknown".
+func WithCaptureGORMError(capture bool) Option {
+	return func(pc *PluginConfig) {
+		pc.CaptureGORMError = capture
+	}
+}
+
+// WithBaggageAnnotations records the given baggage members (e.g. OpenTelemetry baggage) of the statement context as
+// annotations on each subsegment, for correlating X-Ray traces with OTel-instrumented services. Members missing from
+// the context are skipped. The plugin doesn't depend on OpenTelemetry, so the members are looked up with reader; see
+// BaggageReader.
+func WithBaggageAnnotations(reader BaggageReader, keys ...string) Option {
+	return func(pc *PluginConfig) {
+		pc.BaggageReader = reader
+		pc.BaggageAnnotations = keys
+	}
+}
+
+// WithRowsAffectedAnnotation records the rows affected by INSERT, UPDATE and DELETE statements as the numeric
+// db.rows_affected annotation, so unusually large mutations can be found with numeric filter expressions.
+// The db.rows.affected metadata is recorded independently.
+func WithRowsAffectedAnnotation(annotate bool) Option {
+	return func(pc *PluginConfig) {
+		pc.RowsAffectedAnnotation = annotate
+	}
+}
+
+// WithCapturePlaceholderStyle records the bind variable style of the parameterized query as db.placeholder_style
+// ("question" for ?, "dollar" for $1, "named" for :name or @name), to help debug cross-dialect issues.
+func WithCapturePlaceholderStyle(capture bool) Option {
+	return func(pc *PluginConfig) {
+		pc.CapturePlaceholderStyle = capture
+	}
+}
+
+// WithMaxConcurrentSubsegments caps the number of query subsegments open at once. It guards against leaks where the
+// after hook never runs (panics, lost callbacks): past the cap, new queries run untraced and are counted as dropped
+// until open subsegments are closed. The number of open subsegments is reported by Stats.
+func WithMaxConcurrentSubsegments(n int64) Option {
+	return func(pc *PluginConfig) {
+		pc.MaxConcurrentSubsegments = n
+	}
+}
+
+// WithExplainSlowQueries runs EXPLAIN for successful queries that took at least the slow query threshold set by
+// WithSlowKeepFastSample and records a summary of the plan (node descriptions and, on Postgres, estimated rows) as
+// db.plan. Without a threshold nothing is explained. Postgres and SQLite are supported. The EXPLAIN bypasses GORM's
+// callbacks, so it is never traced itself.
+func WithExplainSlowQueries(explain bool) Option {
+	return func(pc *PluginConfig) {
+		pc.ExplainSlowQueries = explain
+	}
+}
+
+// WithTableAllowlist traces only queries on the given tables; all other queries run untraced and are counted as
+// skipped. Queries without a table, such as most raw SQL, are skipped too unless WithTraceUntabledRaw is set.
+func WithTableAllowlist(tables ...string) Option {
+	return func(pc *PluginConfig) {
+		pc.TableAllowlist = tables
+	}
+}
+
+// WithTraceUntabledRaw keeps tracing queries without a table, such as most raw SQL, when WithTableAllowlist is set.
+func WithTraceUntabledRaw(trace bool) Option {
+	return func(pc *PluginConfig) {
+		pc.TraceUntabledRaw = trace
+	}
+}
+
+// WithCaptureEngineVersion records the database server version (version() on Postgres and MySQL, sqlite_version() on
+// SQLite) as db.engine_version, to correlate behavior changes with upgrades. The version is queried once per
+// *sql.DB and cached; it is omitted for other engines or when the lookup fails.
+func WithCaptureEngineVersion(capture bool) Option {
+	return func(pc *PluginConfig) {
+		pc.CaptureEngineVersion = capture
+	}
+}
+
+// WithParseCommenterTags parses sqlcommenter-style comments in the query, e.g. /*controller='users',action='show'*/,
+// and records each key as db.comment.<key> metadata.
+func WithParseCommenterTags(parse bool) Option {
+	return func(pc *PluginConfig) {
+		pc.ParseCommenterTags = parse
+	}
+}
+
+// WithCaptureSavepoints records db.savepoint=true on statements that run while a savepoint is active on their
+// transaction, i.e. inside a nested db.Transaction. GORM doesn't release the savepoint of a nested transaction that
+// succeeded, so it is considered over once a statement is issued through the enclosing transaction's session again.
+func WithCaptureSavepoints(capture bool) Option {
+	return func(pc *PluginConfig) {
+		pc.CaptureSavepoints = capture
+	}
+}
+
+// WithRedactionAudit records db.redacted=true and the scrubbed parts in db.redaction.fields ("vars", "query")
+// whenever query vars were excluded or the query formatter changed the query, as evidence that PII protection ran.
+// Nothing is recorded for statements the redaction left unchanged.
+func WithRedactionAudit(audit bool) Option {
+	return func(pc *PluginConfig) {
+		pc.RedactionAudit = audit
+	}
+}
+
+// WithCapturePipelineSize records the number of statements sent to the database in a single round trip, e.g. a raw
+// Exec of several semicolon-separated statements, as db.pipeline.size. database/sql doesn't pipeline separate calls,
+// so the field is only recorded for multi-statement queries and omitted otherwise.
+func WithCapturePipelineSize(capture bool) Option {
+	return func(pc *PluginConfig) {
+		pc.CapturePipelineSize = capture
+	}
+}
+
+// WithAdditionalNonCritical treats errors matching predicate as non-critical, in addition to the default set
+// (gorm.ErrRecordNotFound, driver.ErrSkip, io.EOF, sql.ErrNoRows). An error is non-critical if either matches.
+func WithAdditionalNonCritical(predicate func(error) bool) Option {
+	return func(pc *PluginConfig) {
+		pc.AdditionalNonCritical = predicate
+	}
+}
+
+// WithCaptureSchema records the schema a query runs against as db.schema, to interpret unqualified table names in
+// multi-schema Postgres apps. The schema is taken from the context (see ContextWithSchema) or the search_path of the
+// dialector's DSN; the server is never queried.
+func WithCaptureSchema(capture bool) Option {
+	return func(pc *PluginConfig) {
+		pc.CaptureSchema = capture
+	}
+}
+
+// WithSkipReasons counts the queries that weren't traced, or whose subsegment was discarded, by reason (see the
+// SkipReason constants) and reports the counters in Stats().SkipReasons. This helps find out why a query is missing
+// when several filters, sampling options and limits are combined.
+func WithSkipReasons(count bool) Option {
+	return func(pc *PluginConfig) {
+		pc.SkipReasons = count
+	}
+}
+
+// WithMetadataMarshaler registers a function applied to complex metadata values (structs, maps, slices, timestamps)
+// before they are added to the subsegment, instead of relying on the SDK's JSON marshaling alone. Use it to
+// normalize timestamps or trim fields. Strings, numbers and booleans are added as-is.
+func WithMetadataMarshaler(marshal func(interface{}) interface{}) Option {
+	return func(pc *PluginConfig) {
+		pc.MetadataMarshaler = marshal
+	}
+}
+
+// WithCaptureCallerChain records up to depth frames of the application stack that issued each query as
+// db.caller.chain, a list of "file:line:func" entries, innermost first. Frames from GORM, this plugin and the
+// standard library are skipped, so the call site can be found through helper layers. Walking the stack has a cost
+// on every query, so this is off by default; resolved frames are cached to keep it low.
+func WithCaptureCallerChain(depth int) Option {
+	return func(pc *PluginConfig) {
+		pc.CaptureCallerChain = depth
+	}
+}
+
+// WithAfterCommit registers a hook fired once GORM has committed the default transaction it wraps a create, update or
+// delete in, e.g. to emit domain metrics on success. The outcome is also recorded as db.tx.outcome metadata. Hooks
+// fire even for statements that aren't traced.
+func WithAfterCommit(fn func(ctx context.Context, tx *gorm.DB)) Option {
+	return func(pc *PluginConfig) {
+		pc.AfterCommit = fn
+	}
+}
+
+// WithAfterRollback registers a hook fired once GORM has rolled back the default transaction of a failed create,
+// update or delete, with the error that caused it. The outcome is also recorded as db.tx.outcome metadata.
+func WithAfterRollback(fn func(ctx context.Context, tx *gorm.DB, err error)) Option {
+	return func(pc *PluginConfig) {
+		pc.AfterRollback = fn
+	}
+}
+
+// WithCaptureDestType records the Go type the query scanned into, e.g. "[]model.Order", as db.dest_type, to help
+// debug mapping issues.
+func WithCaptureDestType(capture bool) Option {
+	return func(pc *PluginConfig) {
+		pc.CaptureDestType = capture
+	}
+}
+
+// WithSuppressDuplicateErrors records an error as a fault only the first time it occurs within a parent segment.
+// Repeats of the same error, by type and message, e.g. in retry loops or preload cascades, are recorded as
+// db.error metadata with db.error.suppressed_count, the number of times it was seen before, so they don't inflate
+// fault counts.
+func WithSuppressDuplicateErrors(suppress bool) Option {
+	return func(pc *PluginConfig) {
+		pc.SuppressDuplicateErrors = suppress
+	}
+}
+
+// WithFlushOnClose closes the fallback segment the plugin opens for a query run without a segment in its context
+// as soon as the query completes, so it is emitted even if the process exits right after, and lets Plugin.Flush
+// close any still open. Without it, fallback segments are never closed and only their subsegments may be streamed.
+func WithFlushOnClose(flush bool) Option {
+	return func(pc *PluginConfig) {
+		pc.FlushOnClose = flush
+	}
+}
+
+// WithCapturePreloadInfo records how many associations a query preloads and their sorted names as db.preload.count
+// and db.preload.names, to help diagnose heavy eager loading.
+func WithCapturePreloadInfo(capture bool) Option {
+	return func(pc *PluginConfig) {
+		pc.CapturePreloadInfo = capture
+	}
+}
+
+// WithErrorAnnotationSampling records the error message of failed queries as the db.error_type annotation, for up
+// to maxDistinct distinct messages per minute. Further messages are recorded as db.error_type metadata only, which
+// keeps high-cardinality messages out of the annotation index.
+func WithErrorAnnotationSampling(maxDistinct int) Option {
+	return func(pc *PluginConfig) {
+		pc.ErrorAnnotationSampling = maxDistinct
+	}
+}
+
+// WithCaptureUpdateColumns records the names of the columns set by UPDATE statements as db.update.columns, to help
+// audit unexpected field changes. Only the names are recorded, the values are masked out.
+func WithCaptureUpdateColumns(capture bool) Option {
+	return func(pc *PluginConfig) {
+		pc.CaptureUpdateColumns = capture
+	}
+}
+
+// WithGroupingKeyFromContext annotates every subsegment with the value stored under key in the statement context,
+// e.g. an endpoint name, as annotationName. This groups the queries a request fans out into by a logical key for
+// aggregation, without restructuring the trace. Queries whose context has no value for key aren't annotated.
+func WithGroupingKeyFromContext(key interface{}, annotationName string) Option {
+	return func(pc *PluginConfig) {
+		pc.GroupingKey = key
+		pc.GroupingAnnotation = annotationName
+	}
+}
+
+// WithCaptureResultSize records an estimate of the data a SELECT fetched as db.result.bytes_estimate, approximated
+// from the rows and columns scanned into the model destination. It helps spot over-fetching. The value is an
+// estimate, not the bytes on the wire, and is omitted when the destination can't be sized, e.g. for raw scans.
+func WithCaptureResultSize(capture bool) Option {
+	return func(pc *PluginConfig) {
+		pc.CaptureResultSize = capture
+	}
+}
+
+// WithMetricsSink reports the operation, table, duration and error of every traced statement to sink.
+func WithMetricsSink(sink MetricsSink) Option {
+	return func(pc *PluginConfig) {
+		pc.MetricsSink = sink
+	}
+}
+
+// WithOperationMetricLabels normalizes the operation and table labels before they are passed to the MetricsSink,
+// e.g. to map per-tenant tables to a canonical name and keep metric cardinality bounded. By default the labels are
+// passed through unchanged.
+func WithOperationMetricLabels(labels func(op, table string) (labelOp, labelTable string)) Option {
+	return func(pc *PluginConfig) {
+		pc.OperationMetricLabels = labels
+	}
+}
+
+// WithDetectNewConnection records db.new_connection, whether the pool opened a connection while the query ran, to
+// tell cold-connection latency apart from slow queries. It compares the pool's stats before and after the query, so
+// with a shared pool a connection opened by a concurrent query may be attributed to this one. Statements in a
+// transaction aren't flagged.
+func WithDetectNewConnection(detect bool) Option {
+	return func(pc *PluginConfig) {
+		pc.DetectNewConnection = detect
+	}
+}
+
+// WithContextValuesToMetadata records, for each context key in mapping, the value found in the statement context as
+// metadata under the mapped name, stringified with fmt.Sprint. Keys missing from the context are skipped. This
+// declares request-scoped enrichment in one place rather than one option per field.
+func WithContextValuesToMetadata(mapping map[interface{}]string) Option {
+	return func(pc *PluginConfig) {
+		pc.ContextValuesToMetadata = mapping
+	}
+}
+
+// WithCaptureNamingStrategy records the type of the GORM naming strategy in effect, e.g. schema.NamingStrategy, as
+// db.naming_strategy metadata, to help debug unexpected table or column names. Like WithVersionMetadata, it is
+// recorded once per parent segment, on its first subsegment.
+func WithCaptureNamingStrategy(capture bool) Option {
+	return func(pc *PluginConfig) {
+		pc.CaptureNamingStrategy = capture
+	}
+}
+
+// WithMaxAnnotationValueLength truncates every string annotation value the plugin emits to at most n characters,
+// ending it with "..." when cut, so long values such as query fingerprints aren't rejected by X-Ray. Values
+// downgraded to metadata by WithAnnotationAllowlist are left untouched.
+func WithMaxAnnotationValueLength(n int) Option {
+	return func(pc *PluginConfig) {
+		pc.MaxAnnotationValueLength = n
+	}
+}
+
+// WithCaptureCount annotates count queries, whose select list starts with count(...) as issued by GORM's Count,
+// with db.method=count, to separate cheap counts from row-fetching selects in dashboards.
+func WithCaptureCount(capture bool) Option {
+	return func(pc *PluginConfig) {
+		pc.CaptureCount = capture
+	}
+}
+
+// WithFallbackSegmentNameFromContext derives the name of the segment the plugin opens for queries run without a
+// segment in their context, e.g. from a batch job id stored in the context. When fn returns an empty string, the
+// segment is named FallbackParent.
+func WithFallbackSegmentNameFromContext(fn func(ctx context.Context) string) Option {
+	return func(pc *PluginConfig) {
+		pc.FallbackSegmentName = fn
+	}
+}
+
+// WithClassifyTermination annotates every query with db.termination: "timeout" when its context deadline expired,
+// "canceled" when its context was canceled, e.g. by a disconnecting client, and "completed" otherwise. Timeouts and
+// cancellations have different operational meaning but both surface as errors.
+func WithClassifyTermination(classify bool) Option {
+	return func(pc *PluginConfig) {
+		pc.ClassifyTermination = classify
+	}
+}
+
+// WithInstanceKeyNamespace prefixes every key the plugin stores on GORM statements, its context keys, its callback
+// names and its plugin name with namespace. This lets several copies of the plugin, e.g. forks or versions vendored
+// side by side, be registered on the same *gorm.DB without overwriting each other's per-statement state.
+func WithInstanceKeyNamespace(namespace string) Option {
+	return func(pc *PluginConfig) {
+		pc.InstanceKeyNamespace = namespace
+	}
+}
+
+// WithQueryEventCallback calls fn once for every completed query the plugin traces, with its operation, table,
+// query, duration, rows affected, error and annotations. It fires whether or not the subsegment ends up emitted, e.g.
+// when it is discarded by sampling, which makes it a seam for feeding other observability backends.
+func WithQueryEventCallback(fn func(QueryEvent)) Option {
+	return func(pc *PluginConfig) {
+		pc.QueryEventCallback = fn
+	}
+}
@@ -0,0 +1,53 @@
+package gormxray
+
+import (
+	"container/list"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+)
+
+// maxTrackedParents bounds the number of parent segments a parentStore keeps state for.
+const maxTrackedParents = 1024
+
+// parentStore keeps a value per parent segment, for features that correlate the queries issued under one segment.
+// It holds at most maxTrackedParents parents and evicts the least recently used one beyond that, so parents that are
+// never closed can't make it grow without bound. It isn't safe for concurrent use; callers hold their own lock.
+type parentStore[V any] struct {
+	order *list.List
+	items map[*xray.Segment]*list.Element
+}
+
+// parentEntry is the value stored for a parent segment.
+type parentEntry[V any] struct {
+	parent *xray.Segment
+	value  V
+}
+
+func newParentStore[V any]() *parentStore[V] {
+	return &parentStore[V]{
+		order: list.New(),
+		items: make(map[*xray.Segment]*list.Element),
+	}
+}
+
+// get returns the value stored for parent and whether it was already tracked. Parents seen for the first time start
+// with the zero value.
+func (s *parentStore[V]) get(parent *xray.Segment) (*V, bool) {
+	if elem, ok := s.items[parent]; ok {
+		s.order.MoveToFront(elem)
+		return &elem.Value.(*parentEntry[V]).value, true
+	}
+	if s.order.Len() >= maxTrackedParents {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.items, oldest.Value.(*parentEntry[V]).parent)
+	}
+	entry := &parentEntry[V]{parent: parent}
+	s.items[parent] = s.order.PushFront(entry)
+	return &entry.value, false
+}
+
+// len returns the number of parents tracked.
+func (s *parentStore[V]) len() int {
+	return s.order.Len()
+}
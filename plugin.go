@@ -1,31 +1,159 @@
 package gormxray
 
 import (
+	"context"
 	"database/sql"
 	"database/sql/driver"
+	"errors"
 	"fmt"
 	"github.com/aws/aws-xray-sdk-go/xray"
 	"io"
 	"log"
+	"math/rand"
+	"net/url"
+	"path/filepath"
+	"reflect"
 	"regexp"
+	"runtime"
+	"sort"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // Regular expressions for parsing SQL statements.
 var (
-	firstWordRegex   = regexp.MustCompile(`^\w+`)
-	cCommentRegex    = regexp.MustCompile(`(?is)/\*.*?\*/`)
-	lineCommentRegex = regexp.MustCompile(`(?im)(?:--|#).*?$`)
-	sqlPrefixRegex   = regexp.MustCompile(`^[\s;]*`)
+	firstWordRegex    = regexp.MustCompile(`^\w+`)
+	cCommentRegex     = regexp.MustCompile(`(?is)/\*.*?\*/`)
+	lineCommentRegex  = regexp.MustCompile(`(?im)(?:--|#).*?$`)
+	sqlPrefixRegex    = regexp.MustCompile(`^[\s;]*`)
+	tableAliasRegex   = regexp.MustCompile("(?i)\\b(?:from|update)\\s+[\\w.\"`\\[\\]]+(?:\\s+as)?\\s+([\\w\"`]+)")
+	stringLitRegex    = regexp.MustCompile(`'(?:[^']|'')*'`)
+	numberLitRegex    = regexp.MustCompile(`\b\d+(?:\.\d+)?\b`)
+	inListRegex       = regexp.MustCompile(`(?i)\bIN \(\?(?:, ?\?)*\)`)
+	tableNameRegex    = regexp.MustCompile("(?i)\\b(?:from|into|update)\\s+([\\w.\"`\\[\\]]+)")
+	dollarVarRegex    = regexp.MustCompile(`\$\d+`)
+	namedVarRegex     = regexp.MustCompile(`(?:^|[^:\w]):\w+|@\w+`)
+	commenterTagRegex = regexp.MustCompile(`^\s*([^=,'\s]+)='((?:[^'\\]|\\.)*)'\s*$`)
+	countQueryRegex   = regexp.MustCompile(`(?is)^\s*SELECT\s+count\s*\(`)
+	setClauseRegex    = regexp.MustCompile(`(?is)\bSET\s+(.*?)(?:\s+(?:WHERE|RETURNING|ORDER\s+BY|LIMIT)\s|$)`)
+	pkConditionRegex  = regexp.MustCompile("(?i)^\\s*(?:[\\w\"`]+\\.)?[\"`]?(\\w+)[\"`]?(?:\\s*=|\\s+IN)\\s*\\(?\\s*\\?\\s*\\)?\\s*$")
 )
 
+// pluginSourceDir is the directory of this package's sources, whose frames are skipped when locating the caller.
+var pluginSourceDir = func() string {
+	_, file, _, _ := runtime.Caller(0)
+	return filepath.Dir(file)
+}()
+
+// nonCriticalErrors are considered non-critical "errors" for X-Ray and don't mark the subsegment as faulty.
+var nonCriticalErrors = []error{
+	gorm.ErrRecordNotFound,
+	driver.ErrSkip,
+	io.EOF,
+	sql.ErrNoRows,
+}
+
+// aliasStopWords are keywords that may follow a table name and must not be mistaken for a bare alias.
+var aliasStopWords = map[string]bool{
+	"where": true, "join": true, "inner": true, "left": true, "right": true, "full": true, "cross": true,
+	"natural": true, "on": true, "using": true, "set": true, "order": true, "group": true, "having": true,
+	"limit": true, "offset": true, "union": true, "for": true, "returning": true, "window": true,
+	"except": true, "intersect": true, "use": true, "force": true, "ignore": true, "with": true,
+}
+
 // PluginConfig allows customization of the plugin's behavior.
 type PluginConfig struct {
 	ExcludeQueryVars bool
 	ExcludeMetrics   bool
 	QueryFormatter   func(string) string
+
+	InheritParentAnnotations []string
+	CapturePlanCache         bool
+	FinalMetadataFunc        func(tx *gorm.DB, dur time.Duration, err error) map[string]interface{}
+	CaptureTableAlias        bool
+	ErrorMatcher             func(err, target error) bool
+	QueryPreviewLength       int
+	DeadlinePressureRatio    float64
+	NPlusOneThreshold        int
+	CompactMetadata          bool
+	RecordSQLState           bool
+	FlattenPreloads          bool
+	AnnotationValueSanitizer func(interface{}) interface{}
+	CaptureResultCount       bool
+	StatementTimeoutMetadata bool
+	BaseContext              context.Context
+	NormalizeNames           bool
+	AnnotationAllowlist      []string
+	MinDurationToRecord      time.Duration
+	NameTemplate             string
+	ErrorSampleRate          float64
+	CaptureBackendPID        bool
+	GroupByModel             bool
+	RateLimitPerSecond       int
+	UppercaseOperationVerb   bool
+	CaptureOrderBy           bool
+	CaptureLimit             bool
+	Enabled                  bool
+	InstrumentConnPool       bool
+	CaptureVarTypes          bool
+	DetailOnError            bool
+	VersionMetadata          bool
+	SubsegmentType           string
+	CacheStatusKey           interface{}
+	SlowQueryThreshold       time.Duration
+	FastQuerySampleRate      float64
+	CaptureAffectedIDs       int
+	TraceHeaderInjection     TraceHeaderMode
+	SelfProfiling            bool
+	FailFastOnFormatterError bool
+	CaptureConstraintErrors  bool
+	SubsegmentPool           bool
+	SampledVarsRate          float64
+	CaptureGORMError         bool
+	BaggageAnnotations       []string
+	BaggageReader            BaggageReader
+	RowsAffectedAnnotation   bool
+	CapturePlaceholderStyle  bool
+	MaxConcurrentSubsegments int64
+	ExplainSlowQueries       bool
+	TableAllowlist           []string
+	TraceUntabledRaw         bool
+	CaptureEngineVersion     bool
+	ParseCommenterTags       bool
+	CaptureSavepoints        bool
+	RedactionAudit           bool
+	CapturePipelineSize      bool
+	AdditionalNonCritical    func(error) bool
+	CaptureSchema            bool
+	SkipReasons              bool
+	MetadataMarshaler        func(interface{}) interface{}
+	CaptureCallerChain       int
+	AfterCommit              func(ctx context.Context, tx *gorm.DB)
+	AfterRollback            func(ctx context.Context, tx *gorm.DB, err error)
+	CaptureDestType          bool
+	SuppressDuplicateErrors  bool
+	FlushOnClose             bool
+	CapturePreloadInfo       bool
+	ErrorAnnotationSampling  int
+	CaptureUpdateColumns     bool
+	GroupingKey              interface{}
+	GroupingAnnotation       string
+	CaptureResultSize        bool
+	MetricsSink              MetricsSink
+	OperationMetricLabels    func(op, table string) (labelOp, labelTable string)
+	DetectNewConnection      bool
+	ContextValuesToMetadata  map[interface{}]string
+	CaptureNamingStrategy    bool
+	MaxAnnotationValueLength int
+	CaptureCount             bool
+	FallbackSegmentName      func(ctx context.Context) string
+	ClassifyTermination      bool
+	InstanceKeyNamespace     string
+	QueryEventCallback       func(QueryEvent)
 }
 
 // Plugin implements gorm.Plugin to integrate AWS X-Ray gormxray into GORM operations.
@@ -33,26 +161,322 @@ type Plugin struct {
 	excludeQueryVars bool
 	excludeMetrics   bool
 	queryFormatter   func(string) string
+
+	inheritParentAnnotations []string
+	capturePlanCache         bool
+	finalMetadataFunc        func(tx *gorm.DB, dur time.Duration, err error) map[string]interface{}
+	captureTableAlias        bool
+	errorMatcher             func(err, target error) bool
+	queryPreviewLength       int
+	deadlinePressureRatio    float64
+	nPlusOne                 *nPlusOneDetector
+	compactMetadata          bool
+	recordSQLState           bool
+	flattenPreloads          bool
+	annotationValueSanitizer func(interface{}) interface{}
+	captureResultCount       bool
+	statementTimeoutMetadata bool
+	baseContext              context.Context
+	normalizeNames           bool
+	annotationAllowlist      map[string]bool
+	minDurationToRecord      time.Duration
+	nameTemplate             string
+	errorSampleRate          float64
+	captureBackendPID        bool
+	backendPIDs              *connCache
+	groupByModel             bool
+	rateLimiter              *tokenBucket
+	uppercaseOperationVerb   bool
+	captureOrderBy           bool
+	captureLimit             bool
+	instrumentConnPool       bool
+	captureVarTypes          bool
+	detailOnError            bool
+	versionMetadata          *segmentOnce
+	subsegmentType           string
+	cacheStatusKey           interface{}
+	slowQueryThreshold       time.Duration
+	fastQuerySampleRate      float64
+	captureAffectedIDs       int
+	traceHeaderInjection     TraceHeaderMode
+	selfProfiling            bool
+	failFastOnFormatterError bool
+	captureConstraintErrors  bool
+	subsegmentPool           bool
+	sampledVarsRate          float64
+	captureGORMError         bool
+	baggageAnnotations       []string
+	baggageReader            BaggageReader
+	rowsAffectedAnnotation   bool
+	capturePlaceholderStyle  bool
+	maxConcurrentSubsegments int64
+	explainSlowQueries       bool
+	tableAllowlist           map[string]bool
+	traceUntabledRaw         bool
+	engineVersions           *connCache
+	parseCommenterTags       bool
+	savepoints               *savepointTracker
+	redactionAudit           bool
+	capturePipelineSize      bool
+	additionalNonCritical    func(error) bool
+	captureSchema            bool
+	skipReasons              map[string]*atomic.Uint64
+	metadataMarshaler        func(interface{}) interface{}
+	captureCallerChain       int
+	afterCommit              func(ctx context.Context, tx *gorm.DB)
+	afterRollback            func(ctx context.Context, tx *gorm.DB, err error)
+	captureDestType          bool
+	duplicateErrors          *errorDeduper
+	fallbacks                *segmentSet
+	capturePreloadInfo       bool
+	errorTypes               *distinctWindow
+	captureUpdateColumns     bool
+	groupingKey              interface{}
+	groupingAnnotation       string
+	captureResultSize        bool
+	metricsSink              MetricsSink
+	operationMetricLabels    func(op, table string) (labelOp, labelTable string)
+	detectNewConnection      bool
+	contextValuesToMetadata  map[interface{}]string
+	namingStrategyOnce       *segmentOnce
+	maxAnnotationValueLength int
+	captureCount             bool
+	fallbackSegmentName      func(ctx context.Context) string
+	classifyTermination      bool
+	instanceKeyNamespace     string
+	queryEventCallback       func(QueryEvent)
+
+	enabled atomic.Bool
+	traced  atomic.Uint64
+	skipped atomic.Uint64
+	dropped atomic.Uint64
+	open    atomic.Int64
+	capped  atomic.Bool
+}
+
+// Stats reports how many queries the plugin traced, how many it skipped and how many it dropped for backpressure,
+// as well as how many subsegments are currently open. With WithSkipReasons, SkipReasons breaks down the queries
+// that weren't traced, or whose subsegment was discarded, by reason.
+type Stats struct {
+	Traced          uint64
+	Skipped         uint64
+	Dropped         uint64
+	OpenSubsegments int64
+	SkipReasons     map[string]uint64
+}
+
+// Reasons a query wasn't traced or its subsegment was discarded, as reported in Stats.SkipReasons.
+const (
+	SkipReasonDisabled         = "disabled"
+	SkipReasonFilteredTable    = "filtered_table"
+	SkipReasonRateLimited      = "rate_limited"
+	SkipReasonMaxOpen          = "max_open"
+	SkipReasonSampledOut       = "sampled_out"
+	SkipReasonBelowMinDuration = "below_min_duration"
+)
+
+// skipReasons lists every reason counted in Stats.SkipReasons.
+var skipReasons = []string{
+	SkipReasonDisabled,
+	SkipReasonFilteredTable,
+	SkipReasonRateLimited,
+	SkipReasonMaxOpen,
+	SkipReasonSampledOut,
+	SkipReasonBelowMinDuration,
 }
 
 // NewPlugin creates a new X-Ray plugin for GORM using functional options.
-func NewPlugin(opts ...Option) gorm.Plugin {
-	cfg := &PluginConfig{}
+func NewPlugin(opts ...Option) *Plugin {
+	cfg := &PluginConfig{
+		Enabled:                  true,
+		ErrorMatcher:             errors.Is,
+		AnnotationValueSanitizer: sanitizeAnnotationValue,
+		ErrorSampleRate:          1,
+	}
 	for _, opt := range opts {
 		opt(cfg)
 	}
-	return &Plugin{
+	p := &Plugin{
 		excludeQueryVars: cfg.ExcludeQueryVars,
 		excludeMetrics:   cfg.ExcludeMetrics,
 		queryFormatter:   cfg.QueryFormatter,
+
+		inheritParentAnnotations: cfg.InheritParentAnnotations,
+		capturePlanCache:         cfg.CapturePlanCache,
+		finalMetadataFunc:        cfg.FinalMetadataFunc,
+		captureTableAlias:        cfg.CaptureTableAlias,
+		errorMatcher:             cfg.ErrorMatcher,
+		queryPreviewLength:       cfg.QueryPreviewLength,
+		deadlinePressureRatio:    cfg.DeadlinePressureRatio,
+		compactMetadata:          cfg.CompactMetadata,
+		recordSQLState:           cfg.RecordSQLState,
+		flattenPreloads:          cfg.FlattenPreloads,
+		annotationValueSanitizer: cfg.AnnotationValueSanitizer,
+		captureResultCount:       cfg.CaptureResultCount,
+		statementTimeoutMetadata: cfg.StatementTimeoutMetadata,
+		baseContext:              cfg.BaseContext,
+		normalizeNames:           cfg.NormalizeNames,
+		minDurationToRecord:      cfg.MinDurationToRecord,
+		nameTemplate:             cfg.NameTemplate,
+		errorSampleRate:          cfg.ErrorSampleRate,
+		captureBackendPID:        cfg.CaptureBackendPID,
+		groupByModel:             cfg.GroupByModel,
+		uppercaseOperationVerb:   cfg.UppercaseOperationVerb,
+		captureOrderBy:           cfg.CaptureOrderBy,
+		captureLimit:             cfg.CaptureLimit,
+		instrumentConnPool:       cfg.InstrumentConnPool,
+		captureVarTypes:          cfg.CaptureVarTypes,
+		detailOnError:            cfg.DetailOnError,
+		subsegmentType:           cfg.SubsegmentType,
+		cacheStatusKey:           cfg.CacheStatusKey,
+		slowQueryThreshold:       cfg.SlowQueryThreshold,
+		fastQuerySampleRate:      cfg.FastQuerySampleRate,
+		captureAffectedIDs:       cfg.CaptureAffectedIDs,
+		traceHeaderInjection:     cfg.TraceHeaderInjection,
+		selfProfiling:            cfg.SelfProfiling,
+		failFastOnFormatterError: cfg.FailFastOnFormatterError,
+		captureConstraintErrors:  cfg.CaptureConstraintErrors,
+		subsegmentPool:           cfg.SubsegmentPool,
+		sampledVarsRate:          cfg.SampledVarsRate,
+		captureGORMError:         cfg.CaptureGORMError,
+		baggageAnnotations:       cfg.BaggageAnnotations,
+		baggageReader:            cfg.BaggageReader,
+		rowsAffectedAnnotation:   cfg.RowsAffectedAnnotation,
+		capturePlaceholderStyle:  cfg.CapturePlaceholderStyle,
+		maxConcurrentSubsegments: cfg.MaxConcurrentSubsegments,
+		explainSlowQueries:       cfg.ExplainSlowQueries,
+		traceUntabledRaw:         cfg.TraceUntabledRaw,
+		parseCommenterTags:       cfg.ParseCommenterTags,
+		redactionAudit:           cfg.RedactionAudit,
+		capturePipelineSize:      cfg.CapturePipelineSize,
+		additionalNonCritical:    cfg.AdditionalNonCritical,
+		captureSchema:            cfg.CaptureSchema,
+		metadataMarshaler:        cfg.MetadataMarshaler,
+		captureCallerChain:       cfg.CaptureCallerChain,
+		afterCommit:              cfg.AfterCommit,
+		afterRollback:            cfg.AfterRollback,
+		captureDestType:          cfg.CaptureDestType,
+		capturePreloadInfo:       cfg.CapturePreloadInfo,
+		captureUpdateColumns:     cfg.CaptureUpdateColumns,
+		groupingKey:              cfg.GroupingKey,
+		groupingAnnotation:       cfg.GroupingAnnotation,
+		captureResultSize:        cfg.CaptureResultSize,
+		metricsSink:              cfg.MetricsSink,
+		operationMetricLabels:    cfg.OperationMetricLabels,
+		detectNewConnection:      cfg.DetectNewConnection,
+		contextValuesToMetadata:  cfg.ContextValuesToMetadata,
+		maxAnnotationValueLength: cfg.MaxAnnotationValueLength,
+		captureCount:             cfg.CaptureCount,
+		fallbackSegmentName:      cfg.FallbackSegmentName,
+		classifyTermination:      cfg.ClassifyTermination,
+		instanceKeyNamespace:     cfg.InstanceKeyNamespace,
+		queryEventCallback:       cfg.QueryEventCallback,
+	}
+	p.enabled.Store(cfg.Enabled)
+	if cfg.RateLimitPerSecond > 0 {
+		p.rateLimiter = newTokenBucket(cfg.RateLimitPerSecond)
+	}
+	if cfg.CaptureBackendPID {
+		p.backendPIDs = newConnCache()
+	}
+	if cfg.CaptureEngineVersion {
+		p.engineVersions = newServerCache()
+	}
+	if cfg.CaptureSavepoints {
+		p.savepoints = newSavepointTracker()
+	}
+	if cfg.SuppressDuplicateErrors {
+		p.duplicateErrors = newErrorDeduper()
+	}
+	if cfg.FlushOnClose {
+		p.fallbacks = newSegmentSet()
+	}
+	if cfg.ErrorAnnotationSampling > 0 {
+		p.errorTypes = newDistinctWindow(cfg.ErrorAnnotationSampling, errorTypeWindow)
+	}
+	if cfg.SkipReasons {
+		p.skipReasons = make(map[string]*atomic.Uint64, len(skipReasons))
+		for _, reason := range skipReasons {
+			p.skipReasons[reason] = new(atomic.Uint64)
+		}
+	}
+	if len(cfg.AnnotationAllowlist) > 0 {
+		p.annotationAllowlist = make(map[string]bool, len(cfg.AnnotationAllowlist))
+		for _, key := range cfg.AnnotationAllowlist {
+			p.annotationAllowlist[key] = true
+		}
+	}
+	if len(cfg.TableAllowlist) > 0 {
+		p.tableAllowlist = make(map[string]bool, len(cfg.TableAllowlist))
+		for _, table := range cfg.TableAllowlist {
+			p.tableAllowlist[table] = true
+		}
+	}
+	if cfg.NPlusOneThreshold > 0 {
+		p.nPlusOne = newNPlusOneDetector(cfg.NPlusOneThreshold)
+	}
+	if cfg.VersionMetadata {
+		p.versionMetadata = newSegmentOnce()
+	}
+	if cfg.CaptureNamingStrategy {
+		p.namingStrategyOnce = newSegmentOnce()
+	}
+	return p
+}
+
+// Stats returns a snapshot of the plugin's trace counters.
+func (p *Plugin) Stats() Stats {
+	stats := Stats{
+		Traced:          p.traced.Load(),
+		Skipped:         p.skipped.Load(),
+		Dropped:         p.dropped.Load(),
+		OpenSubsegments: p.open.Load(),
+	}
+	if p.skipReasons != nil {
+		stats.SkipReasons = make(map[string]uint64, len(p.skipReasons))
+		for reason, count := range p.skipReasons {
+			stats.SkipReasons[reason] = count.Load()
+		}
+	}
+	return stats
+}
+
+// countSkipReason increments the labeled counter for reason, if skip reasons are enabled.
+func (p *Plugin) countSkipReason(reason string) {
+	if count := p.skipReasons[reason]; count != nil {
+		count.Add(1)
 	}
 }
 
-// Name returns the plugin's name.
-func (p Plugin) Name() string {
+// SetEnabled turns tracing on or off at runtime, e.g. as a kill switch during incident response. While disabled,
+// queries run untraced and are counted as skipped; subsegments already started are still closed.
+func (p *Plugin) SetEnabled(enabled bool) {
+	p.enabled.Store(enabled)
+}
+
+// Name returns the plugin's name, suffixed with the namespace set by WithInstanceKeyNamespace.
+func (p *Plugin) Name() string {
+	if p.instanceKeyNamespace != "" {
+		return "xraytracing:" + p.instanceKeyNamespace
+	}
 	return "xraytracing"
 }
 
+// callbackName returns the name under which the hook is registered with GORM, e.g. "xray:before:create", prefixed
+// with the namespace set by WithInstanceKeyNamespace.
+func (p *Plugin) callbackName(hook string) string {
+	return p.instanceKey("xray:" + hook)
+}
+
+// instanceKey prefixes a statement instance key with the namespace set by WithInstanceKeyNamespace, so that several
+// copies of the plugin don't overwrite each other's per-statement state.
+func (p *Plugin) instanceKey(key string) string {
+	if p.instanceKeyNamespace != "" {
+		return p.instanceKeyNamespace + ":" + key
+	}
+	return key
+}
+
 type gormHookFunc func(tx *gorm.DB)
 
 type gormRegister interface {
@@ -60,7 +484,13 @@ type gormRegister interface {
 }
 
 // Initialize attaches the plugin's hooks into the GORM lifecycle.
-func (p Plugin) Initialize(db *gorm.DB) (err error) {
+func (p *Plugin) Initialize(db *gorm.DB) (err error) {
+	if p.failFastOnFormatterError {
+		if err := p.probeQueryFormatter(); err != nil {
+			return err
+		}
+	}
+
 	cb := db.Callback()
 
 	hooks := []struct {
@@ -81,10 +511,43 @@ func (p Plugin) Initialize(db *gorm.DB) (err error) {
 		{cb.Raw().Before("gorm:raw"), p.before("gorm.Raw"), "before:raw"},
 		{cb.Raw().After("gorm:raw"), p.after(), "after:raw"},
 	}
+	const txDone = "gorm:commit_or_rollback_transaction"
+	if p.afterCommit != nil || p.afterRollback != nil {
+		hooks = append(hooks, []struct {
+			callback gormRegister
+			hook     gormHookFunc
+			name     string
+		}{
+			{cb.Create().After(txDone).Before(p.callbackName("after:create")), p.transactionOutcome(), "tx_outcome:create"},
+			{cb.Update().After(txDone).Before(p.callbackName("after:update")), p.transactionOutcome(), "tx_outcome:update"},
+			{cb.Delete().After(txDone).Before(p.callbackName("after:delete")), p.transactionOutcome(), "tx_outcome:delete"},
+		}...)
+	}
+	if p.savepoints != nil {
+		// Savepoints are tracked after the plugin's own after hooks, from every statement whether it was traced or
+		// not, so that skipped or discarded SAVEPOINT and RELEASE statements still count
+		track := func(tx *gorm.DB) { p.savepoints.track(tx) }
+		release := func(tx *gorm.DB) { p.savepoints.release(tx) }
+		hooks = append(hooks, []struct {
+			callback gormRegister
+			hook     gormHookFunc
+			name     string
+		}{
+			{cb.Create().After(p.callbackName("after:create")), track, "savepoints:track:create"},
+			{cb.Query().After(p.callbackName("after:select")), track, "savepoints:track:select"},
+			{cb.Update().After(p.callbackName("after:update")), track, "savepoints:track:update"},
+			{cb.Delete().After(p.callbackName("after:delete")), track, "savepoints:track:delete"},
+			{cb.Row().After(p.callbackName("after:row")), track, "savepoints:track:row"},
+			{cb.Raw().After(p.callbackName("after:raw")), track, "savepoints:track:raw"},
+			{cb.Create().Before(txDone), release, "savepoints:release:create"},
+			{cb.Update().Before(txDone), release, "savepoints:release:update"},
+			{cb.Delete().Before(txDone), release, "savepoints:release:delete"},
+		}...)
+	}
 
 	var firstErr error
 	for _, h := range hooks {
-		if err := h.callback.Register("xray:"+h.name, h.hook); err != nil && firstErr == nil {
+		if err := h.callback.Register(p.callbackName(h.name), h.hook); err != nil && firstErr == nil {
 			firstErr = fmt.Errorf("callback register %s failed: %w", h.name, err)
 			log.Printf("[ERROR] Could not register callback %s: %v", h.name, err)
 		}
@@ -93,64 +556,1169 @@ func (p Plugin) Initialize(db *gorm.DB) (err error) {
 	return firstErr
 }
 
+// formatterProbeQuery is the sample query the query formatter is validated against.
+const formatterProbeQuery = "SELECT * FROM users WHERE id = 1"
+
+// probeQueryFormatter runs the query formatter against a sample query and reports a panic as an error.
+func (p *Plugin) probeQueryFormatter() (err error) {
+	if p.queryFormatter == nil {
+		return nil
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("query formatter panicked on %q: %v", formatterProbeQuery, r)
+		}
+	}()
+	p.queryFormatter(formatterProbeQuery)
+	return nil
+}
+
 // before hook starts an X-Ray subsegment before the query is executed.
 func (p *Plugin) before(spanName string) gormHookFunc {
 	return func(tx *gorm.DB) {
+		hookStart := time.Now()
+		if !p.enabled.Load() {
+			p.skipped.Add(1)
+			p.countSkipReason(SkipReasonDisabled)
+			return
+		}
+
+		if p.flattenPreloads {
+			// Preload sub-queries are recorded on the enclosing query's subsegment
+			if collector := preloadCollectorFrom(tx.Statement.Context, p.instanceKeyNamespace); collector != nil {
+				tx.InstanceSet(p.instanceKey("xray_preload_of"), collector)
+				return
+			}
+		}
+
+		if p.tableAllowlist != nil && !p.tableAllowed(tx.Statement.Table) {
+			p.skipped.Add(1)
+			p.countSkipReason(SkipReasonFilteredTable)
+			return
+		}
+
+		if p.rateLimiter != nil && !p.rateLimiter.allow() {
+			p.dropped.Add(1)
+			p.countSkipReason(SkipReasonRateLimited)
+			return
+		}
+
+		// Subsegments whose after hook never ran stay open; past the cap, no new ones are started
+		if open := p.open.Add(1); p.maxConcurrentSubsegments > 0 && open > p.maxConcurrentSubsegments {
+			p.open.Add(-1)
+			p.dropped.Add(1)
+			p.countSkipReason(SkipReasonMaxOpen)
+			if p.capped.CompareAndSwap(false, true) {
+				log.Printf("[WARN] %d subsegments are open, not tracing new queries until some are closed", p.maxConcurrentSubsegments)
+			}
+			return
+		}
+
 		// Ensure the context has an active parent segment
+		var fallback *xray.Segment
+		ownParent := false
 		if xray.GetSegment(tx.Statement.Context) == nil {
-			tx.Statement.Context, _ = xray.BeginSegment(tx.Statement.Context, "FallbackParent")
+			ctx := tx.Statement.Context
+			if p.baseContext != nil {
+				ctx = mergedContext{Context: ctx, base: p.baseContext}
+			}
+			tx.Statement.Context, fallback = xray.BeginSegment(ctx, p.fallbackName(ctx))
+			ownParent = true
+			if p.fallbacks != nil {
+				p.fallbacks.add(fallback)
+			} else {
+				fallback = nil
+			}
 		}
+		parent := xray.GetSegment(tx.Statement.Context)
 		ctx, seg := xray.BeginSubsegment(tx.Statement.Context, spanName)
+		ctx = context.WithValue(ctx, subsegmentKey{p.instanceKeyNamespace}, seg)
+		if p.subsegmentType != "" {
+			seg.Type = p.subsegmentType
+		}
+		if p.instrumentConnPool {
+			ctx = context.WithValue(ctx, connectTracingKey{p.instanceKeyNamespace}, true)
+		}
 		tx.Statement.Context = ctx
-		tx.InstanceSet("xray_subsegment", seg)
+
+		st := p.newStatementState()
+		st.subsegment = seg
+		st.parent = parent
+		st.fallback = fallback
+		st.ownParent = ownParent
+		st.start = time.Now()
+		tx.InstanceSet(p.instanceKey(statementStateKey), st)
+		p.traced.Add(1)
+
+		if p.deadlinePressureRatio > 0 || p.statementTimeoutMetadata {
+			if deadline, ok := ctx.Deadline(); ok {
+				st.deadlineBudget, st.hasDeadline = time.Until(deadline), true
+			}
+		}
+
+		p.inheritAnnotations(parent, seg)
+		// Looked up before the query runs, while the connection is still free
+		if p.engineVersions != nil {
+			if version, ok := p.engineVersions.lookup(tx, engineVersionQuery(tx.Dialector.Name())); ok {
+				seg.AddMetadata("db.engine_version", version)
+			}
+		}
+		p.annotateBaggage(ctx, seg)
+		if p.detectNewConnection {
+			st.connsOpened, st.hasConnsOpened = connsOpened(tx)
+		}
+		if p.groupingKey != nil {
+			if val := ctx.Value(p.groupingKey); val != nil {
+				p.addAnnotation(seg, p.groupingAnnotation, val)
+			}
+		}
+
+		if p.capturePlanCache {
+			if stmts := preparedStmtDB(tx); stmts != nil {
+				st.planCacheSize, st.hasPlanCache = cachedStmtCount(stmts), true
+			}
+		}
+
+		if p.flattenPreloads {
+			p.startPreloadCollection(tx)
+		}
+
+		if p.traceHeaderInjection != TraceHeaderNone {
+			injectTraceHeader(tx, seg, p.traceHeaderInjection)
+		}
+
+		if p.selfProfiling {
+			st.beforeOverhead = time.Since(hookStart)
+		}
+	}
+}
+
+// tableAllowed reports whether queries on table are traced under the table allowlist. Queries without a table, such
+// as most raw SQL, are only traced with WithTraceUntabledRaw.
+func (p *Plugin) tableAllowed(table string) bool {
+	if table == "" {
+		return p.traceUntabledRaw
+	}
+	return p.tableAllowlist[table]
+}
+
+// closed records that a subsegment opened by the before hook was closed or discarded.
+func (p *Plugin) closed() {
+	if p.open.Add(-1) < p.maxConcurrentSubsegments {
+		p.capped.Store(false)
+	}
+}
+
+// defaultFallbackSegmentName names the segment the plugin opens for queries run without a segment in their context.
+const defaultFallbackSegmentName = "FallbackParent"
+
+// fallbackName returns the name of the fallback segment for ctx, as derived by WithFallbackSegmentNameFromContext.
+func (p *Plugin) fallbackName(ctx context.Context) string {
+	if p.fallbackSegmentName != nil {
+		if name := p.fallbackSegmentName(ctx); name != "" {
+			return name
+		}
+	}
+	return defaultFallbackSegmentName
+}
+
+// Flush closes the fallback segments the plugin opened for queries run without a segment in their context, so they
+// are emitted before a short-lived process (a Lambda handler, a CLI) exits. Call it from a defer in main. It requires
+// WithFlushOnClose and is safe to call at any time, including when no segment is open.
+//
+// The SDK's default emitter has no buffer of its own: it sends each segment to the daemon as soon as it is closed.
+// Segments the application opened itself must still be closed by the application.
+func (p *Plugin) Flush() {
+	if p.fallbacks != nil {
+		p.fallbacks.closeAll()
+	}
+}
+
+// subsegmentKey marks the statement context with the subsegment started by the before hook. Contexts derived from
+// it keep the marker, so the after hook can tell whether the context was swapped out in between.
+type subsegmentKey struct {
+	namespace string
+}
+
+// mergedContext resolves values from the statement context first and falls back to the plugin's base context.
+// Deadlines and cancellation always come from the statement context.
+type mergedContext struct {
+	context.Context
+	base context.Context
+}
+
+func (c mergedContext) Value(key interface{}) interface{} {
+	if val := c.Context.Value(key); val != nil {
+		return val
+	}
+	return c.base.Value(key)
+}
+
+// recordRedaction records which parts of the statement were scrubbed before being recorded: "vars" when the query
+// was recorded without its bound values and "query" when the query formatter changed it.
+func (p *Plugin) recordRedaction(tx *gorm.DB, seg *xray.Segment, query, formatted string) {
+	var fields []string
+	if len(tx.Statement.Vars) > 0 && query == tx.Statement.SQL.String() {
+		fields = append(fields, "vars")
+	}
+	if formatted != query {
+		fields = append(fields, "query")
+	}
+	if len(fields) > 0 {
+		seg.AddMetadata("db.redacted", true)
+		p.addMetadata(seg, "db.redaction.fields", fields)
+	}
+}
+
+// inheritAnnotations copies the configured annotation keys from the parent segment onto the subsegment.
+// Only annotations present on the parent at the time the query starts are visible.
+func (p *Plugin) inheritAnnotations(parent, seg *xray.Segment) {
+	if len(p.inheritParentAnnotations) == 0 || parent == nil || seg == nil {
+		return
+	}
+
+	inherited := make(map[string]interface{}, len(p.inheritParentAnnotations))
+	parent.RLock()
+	for _, key := range p.inheritParentAnnotations {
+		if val, ok := parent.Annotations[key]; ok {
+			inherited[key] = val
+		}
+	}
+	parent.RUnlock()
+
+	for key, val := range inherited {
+		p.addAnnotation(seg, key, val)
+	}
+}
+
+// BaggageReader looks up a baggage member by key on the context, reporting whether it is present. With
+// OpenTelemetry it is typically:
+//
+//	func(ctx context.Context, key string) (string, bool) {
+//		m := baggage.FromContext(ctx).Member(key)
+//		return m.Value(), m.Key() != ""
+//	}
+type BaggageReader func(ctx context.Context, key string) (string, bool)
+
+// annotateBaggage records the configured baggage members found on ctx as annotations on the subsegment.
+func (p *Plugin) annotateBaggage(ctx context.Context, seg *xray.Segment) {
+	if len(p.baggageAnnotations) == 0 || p.baggageReader == nil {
+		return
+	}
+	for _, key := range p.baggageAnnotations {
+		if val, ok := p.baggageReader(ctx, key); ok {
+			p.addAnnotation(seg, key, val)
+		}
 	}
 }
 
 // after hook closes the X-Ray subsegment after the query is executed and adds metadata.
 func (p *Plugin) after() gormHookFunc {
 	return func(tx *gorm.DB) {
-		val, ok := tx.InstanceGet("xray_subsegment")
-		if !ok {
+		hookStart := time.Now()
+		restoreConnPool(tx)
+
+		if val, ok := tx.InstanceGet(p.instanceKey("xray_preload_of")); ok {
+			if collector, ok := val.(*preloadCollector); ok {
+				collector.add(p.formatQuery(p.statementQuery(tx)))
+			}
 			return
 		}
 
-		subSegment, ok := val.(*xray.Segment)
-		if !ok || subSegment == nil {
+		st := p.statementStateOf(tx)
+		if st == nil || st.subsegment == nil {
 			return
 		}
-		defer subSegment.Close(nil)
+		// Deferred first so it runs last, after every other deferred use of st
+		defer p.releaseStatementState(tx, st)
+		defer p.closed()
+		if st.fallback != nil {
+			// Runs once the subsegment is closed, so the fallback segment is emitted complete
+			defer p.fallbacks.close(st.fallback)
+		}
+		subSegment := st.subsegment
 
-		var query string
-		if p.excludeQueryVars {
-			query = tx.Statement.SQL.String()
-		} else {
-			query = tx.Dialector.Explain(tx.Statement.SQL.String(), tx.Statement.Vars...)
+		if tx.Statement.Context.Value(subsegmentKey{p.instanceKeyNamespace}) != subSegment {
+			log.Printf("[WARN] Statement context was replaced between the before and after hooks; closing subsegment %s anyway", subSegment.Name)
+		}
+		p.observeQuery(tx, st)
+		if p.nPlusOne != nil {
+			// Fed before the duration and sampling discards below, since N+1 runs are made of fast queries
+			p.detectNPlusOne(tx, st)
+		}
+		// The query as recorded on the subsegment, set once it has been formatted
+		var recordedQuery *string
+		if p.queryEventCallback != nil {
+			dur := st.queryDuration()
+			// Runs once the after hook is done, so the event carries every annotation
+			defer func() {
+				if recordedQuery == nil {
+					// Discarded before the query was recorded
+					query := p.formatQuery(p.statementQuery(tx))
+					recordedQuery = &query
+				}
+				p.emitQueryEvent(tx, subSegment, *recordedQuery, dur)
+			}()
+		}
+
+		// Trivially fast queries are dropped unless they failed
+		if p.minDurationToRecord > 0 && st.queryDuration() < p.minDurationToRecord && p.isNonCriticalError(tx.Error) {
+			discardSubsegment(st)
+			p.countSkipReason(SkipReasonBelowMinDuration)
+			return
+		}
+		// Slow queries are always kept, fast successful ones only at the sample rate
+		if p.slowQueryThreshold > 0 && st.queryDuration() < p.slowQueryThreshold && p.isNonCriticalError(tx.Error) &&
+			!sampled(p.fastQuerySampleRate) {
+			discardSubsegment(st)
+			p.countSkipReason(SkipReasonSampledOut)
+			return
+		}
+		defer subSegment.Close(nil)
+		if p.selfProfiling {
+			// Runs before the deferred Close, once everything else has been recorded
+			defer func() {
+				overhead := st.beforeOverhead + time.Since(hookStart)
+				subSegment.AddMetadata("db.instrumentation_overhead_us", overhead.Microseconds())
+			}()
 		}
 
+		query := p.statementQuery(tx)
+		if p.excludeQueryVars && p.sampledVarsRate > 0 && len(tx.Statement.Vars) > 0 &&
+			query == tx.Statement.SQL.String() && sampled(p.sampledVarsRate) {
+			query = tx.Dialector.Explain(query, tx.Statement.Vars...)
+			subSegment.AddMetadata("db.vars.sampled", true)
+		}
 		formatQuery := p.formatQuery(query)
-		subSegment.AddMetadata("db.query", formatQuery)
-		subSegment.AddMetadata("db.operation", dbOperation(formatQuery))
-		if tx.Statement.Table != "" {
-			subSegment.AddMetadata("db.table", tx.Statement.Table)
+		recordedQuery = &formatQuery
+		if p.redactionAudit {
+			p.recordRedaction(tx, subSegment, query, formatQuery)
+		}
+		if name := p.subsegmentName(tx); name != "" {
+			renameSegment(subSegment, name)
+		}
+		if p.compactMetadata {
+			p.addMetadata(subSegment, "db", compactMetadata(tx, st, formatQuery))
+		} else {
+			subSegment.AddMetadata("db.query", formatQuery)
+			subSegment.AddMetadata("db.operation", dbOperation(formatQuery))
+			if tx.Statement.Table != "" {
+				subSegment.AddMetadata("db.table", tx.Statement.Table)
+			}
+			if rows, ok := rowsAffected(tx); ok {
+				subSegment.AddMetadata("db.rows.affected", rows)
+			}
+		}
+		if op := dbOperation(formatQuery); p.rowsAffectedAnnotation && (op == "insert" || op == "update" || op == "delete") {
+			if rows, ok := rowsAffected(tx); ok {
+				p.addAnnotation(subSegment, "db.rows_affected", rows)
+			}
+		}
+		if p.uppercaseOperationVerb {
+			subSegment.AddMetadata("db.operation.verb", strings.ToUpper(dbOperation(formatQuery)))
+		}
+		if p.queryPreviewLength > 0 {
+			subSegment.AddMetadata("db.query.preview", queryPreview(formatQuery, p.queryPreviewLength))
+		}
+		if p.captureTableAlias {
+			if alias := tableAlias(tx.Statement.SQL.String()); alias != "" {
+				subSegment.AddMetadata("db.table.alias", alias)
+			}
+		}
+		if p.captureOrderBy {
+			if columns := orderByColumns(tx); len(columns) > 0 {
+				subSegment.AddMetadata("db.order_by", columns)
+			}
+		}
+		if p.captureLimit {
+			if limit := maskedLimit(tx); limit != "" {
+				subSegment.AddMetadata("db.limit", limit)
+			}
+		}
+		if p.captureUpdateColumns && dbOperation(formatQuery) == "update" {
+			if columns := updateColumns(tx); len(columns) > 0 {
+				p.addMetadata(subSegment, "db.update.columns", columns)
+			}
+		}
+		if p.captureCount && countQueryRegex.MatchString(tx.Statement.SQL.String()) {
+			p.addAnnotation(subSegment, "db.method", "count")
+		}
+		if p.captureVarTypes && len(tx.Statement.Vars) > 0 {
+			subSegment.AddMetadata("db.vars.types", varTypes(tx.Statement.Vars))
+		}
+		if op := dbOperation(formatQuery); p.captureAffectedIDs > 0 && (op == "update" || op == "delete") {
+			if ids := primaryKeyValues(tx); len(ids) > 0 {
+				if len(ids) > p.captureAffectedIDs {
+					subSegment.AddMetadata("db.affected_ids.total", len(ids))
+					ids = ids[:p.captureAffectedIDs]
+				}
+				if p.excludeQueryVars {
+					for i := range ids {
+						ids[i] = "?"
+					}
+				}
+				p.addMetadata(subSegment, "db.affected_ids", ids)
+			}
+		}
+		if p.parseCommenterTags {
+			for key, val := range commenterTags(tx.Statement.SQL.String()) {
+				subSegment.AddMetadata("db.comment."+key, val)
+			}
+		}
+		if softDeleted(tx) {
+			subSegment.AddMetadata("db.soft_delete", true)
+		}
+		if st.hasConnsOpened {
+			if opened, ok := connsOpened(tx); ok {
+				subSegment.AddMetadata("db.new_connection", opened > st.connsOpened)
+			}
+		}
+		for key, name := range p.contextValuesToMetadata {
+			if val := tx.Statement.Context.Value(key); val != nil {
+				subSegment.AddMetadata(name, fmt.Sprint(val))
+			}
+		}
+		if p.captureDestType {
+			if destType := destTypeName(tx.Statement.Dest); destType != "" {
+				subSegment.AddMetadata("db.dest_type", destType)
+			}
+		}
+		if st.txOutcome != "" {
+			subSegment.AddMetadata("db.tx.outcome", st.txOutcome)
+		}
+		if p.savepoints != nil && p.savepoints.inSavepoint(tx) {
+			subSegment.AddMetadata("db.savepoint", true)
+		}
+		if p.captureSchema {
+			if schema := statementSchema(tx); schema != "" {
+				subSegment.AddMetadata("db.schema", schema)
+			}
+		}
+		if p.capturePipelineSize {
+			if size := statementCount(tx.Statement.SQL.String()); size > 1 {
+				subSegment.AddMetadata("db.pipeline.size", size)
+			}
+		}
+		if p.capturePlaceholderStyle {
+			if style := placeholderStyle(tx.Statement.SQL.String()); style != "" {
+				subSegment.AddMetadata("db.placeholder_style", style)
+			}
 		}
-		if tx.Statement.RowsAffected != -1 {
-			subSegment.AddMetadata("db.rows.affected", tx.Statement.RowsAffected)
+		if p.captureResultCount && dbOperation(formatQuery) == "select" {
+			if count, ok := resultCount(tx.Statement.Dest); ok {
+				subSegment.AddMetadata("db.result.count", count)
+			}
+		}
+		if p.captureResultSize && dbOperation(formatQuery) == "select" {
+			if size, ok := resultBytesEstimate(tx); ok {
+				subSegment.AddMetadata("db.result.bytes_estimate", size)
+			}
+		}
+		if p.cacheStatusKey != nil {
+			subSegment.AddMetadata("db.cache", cacheStatus(tx, p.cacheStatusKey))
+		}
+		if p.groupByModel && tx.Statement.Schema != nil {
+			p.addAnnotation(subSegment, "model", tx.Statement.Schema.Name)
+		}
+		if p.captureBackendPID {
+			if pid, ok := p.backendPIDs.lookup(tx, backendPIDQuery(tx.Dialector.Name())); ok {
+				subSegment.AddMetadata("db.backend_pid", pid)
+			}
+		}
+		if val, ok := tx.InstanceGet(p.instanceKey("xray_preloads")); ok {
+			if collector, ok := val.(*preloadCollector); ok {
+				if queries := collector.list(); len(queries) > 0 {
+					p.addMetadata(subSegment, "db.preloads", queries)
+				}
+			}
+		}
+		if p.capturePreloadInfo && len(tx.Statement.Preloads) > 0 {
+			subSegment.AddMetadata("db.preload.count", len(tx.Statement.Preloads))
+			p.addMetadata(subSegment, "db.preload.names", preloadNames(tx))
+		}
+		if p.capturePlanCache {
+			if status := planCacheStatus(tx, st); status != "" {
+				subSegment.AddMetadata("db.plan.cache", status)
+			}
+		}
+
+		if p.classifyTermination {
+			p.addAnnotation(subSegment, "db.termination", termination(tx))
 		}
 
 		// Record errors if any
-		switch tx.Error {
-		case nil,
-			gorm.ErrRecordNotFound,
-			driver.ErrSkip,
-			io.EOF,
-			sql.ErrNoRows:
-			// These are considered non-critical "errors" for X-Ray.
-		default:
-			subSegment.AddError(tx.Error)
+		if !p.isNonCriticalError(tx.Error) {
+			if seen := p.duplicateErrorCount(st, tx.Error); seen > 0 {
+				subSegment.AddMetadata("db.error", true)
+				subSegment.AddMetadata("db.error.suppressed_count", seen)
+			} else if sampled(p.errorSampleRate) {
+				subSegment.AddError(tx.Error)
+			} else {
+				subSegment.AddMetadata("db.error", true)
+			}
+			if p.recordSQLState {
+				if code := sqlState(tx.Error); code != "" {
+					p.addAnnotation(subSegment, "db.sqlstate", code)
+				}
+			}
+			if p.errorTypes != nil {
+				if msg := tx.Error.Error(); p.errorTypes.allow(msg) {
+					p.addAnnotation(subSegment, "db.error_type", msg)
+				} else {
+					subSegment.AddMetadata("db.error_type", msg)
+				}
+			}
+			if p.captureGORMError {
+				p.addAnnotation(subSegment, "db.error_layer", errorLayer(tx.Error))
+			}
+			if p.captureConstraintErrors {
+				if constraint, ok := uniqueViolation(tx.Error); ok {
+					p.addAnnotation(subSegment, "db.error_kind", "unique_violation")
+					if constraint != "" {
+						subSegment.AddMetadata("db.constraint", constraint)
+					}
+				}
+			}
+			if p.detailOnError {
+				if caller := callerLocation(); caller != "" {
+					subSegment.AddMetadata("db.caller", caller)
+				}
+			}
+		}
+
+		if p.captureCallerChain > 0 {
+			if chain := callerChain(p.captureCallerChain); len(chain) > 0 {
+				p.addMetadata(subSegment, "db.caller.chain", chain)
+			}
+		}
+
+		if p.explainSlowQueries && p.slowQueryThreshold > 0 && st.queryDuration() >= p.slowQueryThreshold &&
+			tx.Error == nil {
+			p.recordExplainPlan(tx, st)
+		}
+
+		if p.versionMetadata != nil {
+			if p.versionMetadata.first(st) {
+				subSegment.AddMetadata("gormxray.version", moduleVersion(modulePath))
+				subSegment.AddMetadata("gorm.version", moduleVersion("gorm.io/gorm"))
+			}
+		}
+		if p.namingStrategyOnce != nil {
+			if p.namingStrategyOnce.first(st) {
+				subSegment.AddMetadata("db.naming_strategy", fmt.Sprintf("%T", tx.NamingStrategy))
+			}
+		}
+
+		if p.statementTimeoutMetadata {
+			if st.hasDeadline {
+				subSegment.AddMetadata("db.statement_timeout_ms", st.deadlineBudget.Milliseconds())
+			}
+		}
+		if p.deadlinePressureRatio > 0 && p.underDeadlinePressure(st) {
+			p.addAnnotation(subSegment, "db.deadline_pressure", true)
+		}
+
+		if p.finalMetadataFunc != nil {
+			for key, val := range p.finalMetadataFunc(tx, st.queryDuration(), tx.Error) {
+				p.addMetadata(subSegment, key, val)
+			}
 		}
 	}
 }
 
+// underDeadlinePressure reports whether the query consumed more than the configured fraction of the time that
+// remained on the context deadline when it started.
+func (p *Plugin) underDeadlinePressure(st *statementState) bool {
+	if !st.hasDeadline {
+		return false
+	}
+	if st.deadlineBudget <= 0 {
+		return true
+	}
+	return float64(st.queryDuration())/float64(st.deadlineBudget) >= p.deadlinePressureRatio
+}
+
+// updateColumns returns the names of the columns set by the statement's SET clause. The values are never included.
+// GORM drops the SET clause it builds for Update and Updates once the statement ran, so the names are read back
+// from the SQL in that case.
+func updateColumns(tx *gorm.DB) []string {
+	if c, ok := tx.Statement.Clauses["SET"]; ok {
+		if set, ok := c.Expression.(clause.Set); ok {
+			columns := make([]string, 0, len(set))
+			for _, assignment := range set {
+				columns = append(columns, assignment.Column.Name)
+			}
+			return columns
+		}
+	}
+
+	m := setClauseRegex.FindStringSubmatch(tx.Statement.SQL.String())
+	if m == nil {
+		return nil
+	}
+	var columns []string
+	for _, assignment := range splitTopLevel(m[1]) {
+		if i := strings.Index(assignment, "="); i > 0 {
+			columns = append(columns, strings.Trim(strings.TrimSpace(assignment[:i]), "`\"[]"))
+		}
+	}
+	return columns
+}
+
+// splitTopLevel splits s on the commas that aren't nested in parentheses or quotes.
+func splitTopLevel(s string) []string {
+	var parts []string
+	depth, start := 0, 0
+	var quote rune
+	for i, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"' || r == '`':
+			quote = r
+		case r == '(':
+			depth++
+		case r == ')':
+			depth--
+		case r == ',' && depth == 0:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// orderByColumns returns the columns of the statement's ORDER BY clause, including their direction.
+func orderByColumns(tx *gorm.DB) []string {
+	c, ok := tx.Statement.Clauses["ORDER BY"]
+	if !ok {
+		return nil
+	}
+	orderBy, ok := c.Expression.(clause.OrderBy)
+	if !ok {
+		return nil
+	}
+	columns := make([]string, 0, len(orderBy.Columns))
+	for _, col := range orderBy.Columns {
+		name := col.Column.Name
+		if col.Column.Table != "" && !col.Column.Raw {
+			name = col.Column.Table + "." + name
+		}
+		if col.Desc {
+			name += " desc"
+		}
+		columns = append(columns, name)
+	}
+	return columns
+}
+
+// primaryKeyValues returns the primary key values the statement's WHERE clause restricts it to, taken from
+// "pk IN (...)" and "pk = ?" conditions on the model's primary key, whether built by GORM or written as
+// Where("id IN ?", ids).
+func primaryKeyValues(tx *gorm.DB) []string {
+	c, ok := tx.Statement.Clauses["WHERE"]
+	if !ok || tx.Statement.Schema == nil || tx.Statement.Schema.PrioritizedPrimaryField == nil {
+		return nil
+	}
+	where, ok := c.Expression.(clause.Where)
+	if !ok {
+		return nil
+	}
+	pk := tx.Statement.Schema.PrioritizedPrimaryField.DBName
+	isPK := func(column interface{}) bool {
+		switch col := column.(type) {
+		case clause.Column:
+			return col.Name == clause.PrimaryKey || col.Name == pk
+		case string:
+			return col == pk
+		}
+		return false
+	}
+
+	var ids []string
+	for _, expr := range where.Exprs {
+		switch cond := expr.(type) {
+		case clause.IN:
+			if isPK(cond.Column) {
+				for _, v := range cond.Values {
+					ids = append(ids, fmt.Sprint(v))
+				}
+			}
+		case clause.Eq:
+			if isPK(cond.Column) {
+				ids = append(ids, fmt.Sprint(cond.Value))
+			}
+		case clause.Expr:
+			m := pkConditionRegex.FindStringSubmatch(cond.SQL)
+			if m == nil || len(cond.Vars) != 1 || !isPK(m[1]) {
+				continue
+			}
+			v := reflect.ValueOf(cond.Vars[0])
+			if (v.Kind() == reflect.Slice && v.Type().Elem().Kind() != reflect.Uint8) || v.Kind() == reflect.Array {
+				for i := 0; i < v.Len(); i++ {
+					ids = append(ids, fmt.Sprint(v.Index(i).Interface()))
+				}
+			} else {
+				ids = append(ids, fmt.Sprint(cond.Vars[0]))
+			}
+		}
+	}
+	return ids
+}
+
+// maskedLimit describes the statement's LIMIT clause with its values masked, e.g. "LIMIT ? OFFSET ?".
+func maskedLimit(tx *gorm.DB) string {
+	c, ok := tx.Statement.Clauses["LIMIT"]
+	if !ok {
+		return ""
+	}
+	limit, ok := c.Expression.(clause.Limit)
+	if !ok {
+		return ""
+	}
+	var parts []string
+	if limit.Limit != nil && *limit.Limit >= 0 {
+		parts = append(parts, "LIMIT ?")
+	}
+	if limit.Offset > 0 {
+		parts = append(parts, "OFFSET ?")
+	}
+	return strings.Join(parts, " ")
+}
+
+// resultCount counts the rows populated in dest: the length of a slice or array, or 0/1 for a single struct
+// depending on whether it is still the zero value. It reports false for nil or unsupported destinations.
+func resultCount(dest interface{}) (int, bool) {
+	if dest == nil {
+		return 0, false
+	}
+	v := reflect.ValueOf(dest)
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return 0, false
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		return v.Len(), true
+	case reflect.Struct, reflect.Map:
+		if v.IsZero() {
+			return 0, true
+		}
+		return 1, true
+	}
+	return 0, false
+}
+
+// resultBytesEstimate approximates the size of the rows scanned into the statement's model destination by summing,
+// for each row and mapped column, the length of strings and byte slices or the in-memory size of other values. It
+// is an estimate of the data fetched, not of the bytes on the wire, and reports false when the destination isn't a
+// model or a slice of models.
+func resultBytesEstimate(tx *gorm.DB) (int64, bool) {
+	sch := tx.Statement.Schema
+	if sch == nil || tx.Statement.Dest == nil {
+		return 0, false
+	}
+	v := reflect.Indirect(reflect.ValueOf(tx.Statement.Dest))
+	var rows []reflect.Value
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			rows = append(rows, reflect.Indirect(v.Index(i)))
+		}
+	case reflect.Struct:
+		if !v.IsZero() {
+			rows = append(rows, v)
+		}
+	default:
+		return 0, false
+	}
+
+	var size int64
+	for _, row := range rows {
+		if row.Kind() != reflect.Struct || row.Type() != sch.ModelType {
+			return 0, false
+		}
+		for _, name := range sch.DBNames {
+			val, _ := sch.FieldsByDBName[name].ValueOf(tx.Statement.Context, row)
+			size += valueBytes(val)
+		}
+	}
+	return size, true
+}
+
+// valueBytes approximates the size of a scanned column value.
+func valueBytes(val interface{}) int64 {
+	v := reflect.ValueOf(val)
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return 0
+		}
+		v = v.Elem()
+	}
+	switch {
+	case !v.IsValid():
+		return 0
+	case v.Kind() == reflect.String:
+		return int64(v.Len())
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+		return int64(v.Len())
+	}
+	return int64(v.Type().Size())
+}
+
+// compactMetadata assembles the core query metadata into a single object recorded under the "db" key.
+func compactMetadata(tx *gorm.DB, st *statementState, query string) map[string]interface{} {
+	obj := map[string]interface{}{
+		"operation":   dbOperation(query),
+		"query":       query,
+		"duration_ms": float64(st.queryDuration()) / float64(time.Millisecond),
+	}
+	if tx.Statement.Table != "" {
+		obj["table"] = tx.Statement.Table
+	}
+	if rows, ok := rowsAffected(tx); ok {
+		obj["rows_affected"] = rows
+	}
+	return obj
+}
+
+// rowsAffected returns the number of rows affected by the statement and whether it is known. GORM leaves
+// RowsAffected at -1 on the Row path, which runs the statement through QueryRowContext/QueryContext and never
+// sees an sql.Result, so writes issued that way (e.g. UPDATE ... RETURNING) are reported as unknown rather than guessed.
+func rowsAffected(tx *gorm.DB) (int64, bool) {
+	if tx.Statement.RowsAffected < 0 {
+		return 0, false
+	}
+	return tx.Statement.RowsAffected, true
+}
+
+// discardSubsegment removes the statement's subsegment from its parent so it is never emitted. If that isn't possible, the subsegment is
+// closed without any metadata.
+func discardSubsegment(st *statementState) {
+	if st.parent != nil && st.parent.RemoveSubsegment(st.subsegment) {
+		return
+	}
+	st.subsegment.Close(nil)
+}
+
+// preparedStmtDB returns GORM's prepared statement cache behind the statement's connection, if PrepareStmt mode is on.
+func preparedStmtDB(tx *gorm.DB) *gorm.PreparedStmtDB {
+	switch pool := tx.Statement.ConnPool.(type) {
+	case *gorm.PreparedStmtDB:
+		return pool
+	case *gorm.PreparedStmtTX:
+		return pool.PreparedStmtDB
+	}
+	return nil
+}
+
+// cachedStmtCount returns the number of statements currently held in the prepared statement cache.
+func cachedStmtCount(stmts *gorm.PreparedStmtDB) int {
+	stmts.Mux.RLock()
+	defer stmts.Mux.RUnlock()
+	return len(stmts.Stmts)
+}
+
+// planCacheStatus reports "miss" if the query grew the prepared statement cache and "hit" if it reused an entry.
+// It returns an empty string when the driver path doesn't expose a statement cache.
+func planCacheStatus(tx *gorm.DB, st *statementState) string {
+	if !st.hasPlanCache {
+		return ""
+	}
+	stmts := preparedStmtDB(tx)
+	if stmts == nil {
+		return ""
+	}
+	if cachedStmtCount(stmts) > st.planCacheSize {
+		return "miss"
+	}
+	return "hit"
+}
+
+// isNonCriticalError reports whether err matches one of the non-critical errors using the configured matcher, or the
+// additional non-critical predicate.
+func (p *Plugin) isNonCriticalError(err error) bool {
+	if err == nil {
+		return true
+	}
+	for _, target := range nonCriticalErrors {
+		if p.errorMatcher(err, target) {
+			return true
+		}
+	}
+	return p.additionalNonCritical != nil && p.additionalNonCritical(err)
+}
+
+// sampled makes a random sampling decision that is true with probability rate.
+func sampled(rate float64) bool {
+	if rate >= 1 {
+		return true
+	}
+	return rand.Float64() < rate
+}
+
+// sqlStateError is implemented by driver errors that expose a SQLSTATE code (e.g. pgconn.PgError, pq.Error).
+type sqlStateError interface {
+	SQLState() string
+}
+
+// sqlState extracts the SQLSTATE code from err or any error it wraps. It returns an empty string if none is exposed.
+func sqlState(err error) string {
+	var stateErr sqlStateError
+	if errors.As(err, &stateErr) {
+		return stateErr.SQLState()
+	}
+	return ""
+}
+
+// statementQuery returns the statement's SQL, with variables interpolated unless they are excluded.
+func (p *Plugin) statementQuery(tx *gorm.DB) string {
+	if p.excludeQueryVars && !(p.detailOnError && !p.isNonCriticalError(tx.Error)) {
+		return tx.Statement.SQL.String()
+	}
+	return tx.Dialector.Explain(tx.Statement.SQL.String(), tx.Statement.Vars...)
+}
+
+// commenterTags parses sqlcommenter-style comments, e.g. /*controller='users',action='show'*/, into their
+// URL-decoded key/value pairs. Comments that aren't made up entirely of such pairs are ignored.
+func commenterTags(query string) map[string]string {
+	var tags map[string]string
+	for _, comment := range cCommentRegex.FindAllString(query, -1) {
+		pairs := strings.Split(strings.TrimSuffix(strings.TrimPrefix(comment, "/*"), "*/"), ",")
+		parsed := make(map[string]string, len(pairs))
+		for _, pair := range pairs {
+			m := commenterTagRegex.FindStringSubmatch(pair)
+			if m == nil {
+				parsed = nil
+				break
+			}
+			key, errKey := url.QueryUnescape(m[1])
+			val, errVal := url.QueryUnescape(strings.ReplaceAll(m[2], `\'`, "'"))
+			if errKey != nil || errVal != nil {
+				parsed = nil
+				break
+			}
+			parsed[key] = val
+		}
+		for key, val := range parsed {
+			if tags == nil {
+				tags = make(map[string]string)
+			}
+			tags[key] = val
+		}
+	}
+	return tags
+}
+
+// statementCount returns the number of SQL statements sent together in query, separated by semicolons outside of
+// string literals and comments.
+func statementCount(query string) int {
+	query = stringLitRegex.ReplaceAllString(query, "''")
+	query = cCommentRegex.ReplaceAllString(query, "")
+	query = lineCommentRegex.ReplaceAllString(query, "")
+	count := 0
+	for _, stmt := range strings.Split(query, ";") {
+		if strings.TrimSpace(stmt) != "" {
+			count++
+		}
+	}
+	return count
+}
+
+// placeholderStyle reports the bind variable style of the parameterized query: "dollar" for $1, "question" for ?
+// and "named" for :name or @name placeholders. String literals are ignored; an empty string means no placeholders.
+func placeholderStyle(query string) string {
+	query = stringLitRegex.ReplaceAllString(query, "''")
+	switch {
+	case dollarVarRegex.MatchString(query):
+		return "dollar"
+	case strings.Contains(query, "?"):
+		return "question"
+	case namedVarRegex.MatchString(query):
+		return "named"
+	}
+	return ""
+}
+
+// cacheStatus reports "hit" when a cache layer flagged the statement as served from cache, either through a
+// context value stored under key or, for string keys, a statement setting (db.Set). Anything else is a "miss".
+func cacheStatus(tx *gorm.DB, key interface{}) string {
+	val := tx.Statement.Context.Value(key)
+	if name, ok := key.(string); ok && val == nil {
+		val, _ = tx.Get(name)
+	}
+	if hit, _ := val.(bool); hit {
+		return "hit"
+	}
+	return "miss"
+}
+
+// callerLocation returns the file:line of the first frame outside GORM and this plugin, i.e. the application
+// code that issued the query.
+func callerLocation() string {
+	pcs := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(2, pcs)])
+	for {
+		frame, more := frames.Next()
+		if !internalFrame(frame) && frame.File != "" {
+			return fmt.Sprintf("%s:%d", frame.File, frame.Line)
+		}
+		if !more {
+			return ""
+		}
+	}
+}
+
+// internalFrame reports whether frame belongs to GORM or to this plugin's own (non-test) code.
+func internalFrame(frame runtime.Frame) bool {
+	return strings.HasPrefix(frame.Function, "gorm.io/") ||
+		(filepath.Dir(frame.File) == pluginSourceDir && !strings.HasSuffix(frame.File, "_test.go"))
+}
+
+// softDeleted reports whether GORM's soft delete rewrote the statement: a Delete on a model with a gorm.DeletedAt
+// field runs as an UPDATE setting deleted_at, and queries on it get a "deleted_at IS NULL" condition.
+func softDeleted(tx *gorm.DB) bool {
+	_, ok := tx.Statement.Clauses["soft_delete_enabled"]
+	return ok
+}
+
+// preloadNames returns the sorted names of the associations the statement preloads, e.g. ["Orders", "Orders.Items"].
+func preloadNames(tx *gorm.DB) []string {
+	names := make([]string, 0, len(tx.Statement.Preloads))
+	for name := range tx.Statement.Preloads {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// termination classifies how the statement ended: "timeout" when its context deadline expired, "canceled" when its
+// context was canceled, and "completed" otherwise, including for queries that failed for other reasons. Drivers don't
+// always wrap the context error, so the context itself is checked when the statement failed.
+func termination(tx *gorm.DB) string {
+	if tx.Error == nil {
+		return "completed"
+	}
+	err := tx.Error
+	if ctxErr := tx.Statement.Context.Err(); ctxErr != nil && !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, context.Canceled) {
+		err = ctxErr
+	}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	}
+	return "completed"
+}
+
+// destTypeName returns the Go type the statement scanned into, with pointers unwrapped, e.g. "[]model.Order". It
+// returns an empty string if there is no destination.
+func destTypeName(dest interface{}) string {
+	if dest == nil {
+		return ""
+	}
+	t := reflect.TypeOf(dest)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.String()
+}
+
+// varTypes returns a compact signature of the Go types bound to the statement, e.g. "[int,string,time.Time]".
+// It never includes the values themselves.
+func varTypes(vars []interface{}) string {
+	types := make([]string, len(vars))
+	for i, v := range vars {
+		types[i] = fmt.Sprintf("%T", v)
+	}
+	return "[" + strings.Join(types, ",") + "]"
+}
+
+// addAnnotation sanitizes value and adds it to seg as an annotation. All annotations emitted by the plugin go
+// through here, since X-Ray silently drops values that aren't strings, numbers or booleans. Keys missing from a
+// configured allowlist are downgraded to metadata.
+func (p *Plugin) addAnnotation(seg *xray.Segment, key string, value interface{}) {
+	if p.annotationAllowlist != nil && !p.annotationAllowlist[key] {
+		p.addMetadata(seg, key, value)
+		return
+	}
+	value = p.annotationValueSanitizer(value)
+	if s, ok := value.(string); ok && p.maxAnnotationValueLength > 0 {
+		value = truncateValue(s, p.maxAnnotationValueLength)
+	}
+	seg.AddAnnotation(key, value)
+}
+
+// truncatedSuffix marks annotation values shortened by WithMaxAnnotationValueLength.
+const truncatedSuffix = "..."
+
+// truncateValue shortens s to at most n runes, ending it with truncatedSuffix when it was cut.
+func truncateValue(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	if n <= len(truncatedSuffix) {
+		return string(runes[:n])
+	}
+	return string(runes[:n-len(truncatedSuffix)]) + truncatedSuffix
+}
+
+// addMetadata adds value to seg as metadata. Values that aren't strings, numbers or booleans, such as structs, maps,
+// slices and timestamps, are passed through the configured metadata marshaler first.
+func (p *Plugin) addMetadata(seg *xray.Segment, key string, value interface{}) {
+	if p.metadataMarshaler != nil && !isScalar(value) {
+		value = p.metadataMarshaler(value)
+	}
+	seg.AddMetadata(key, value)
+}
+
+// isScalar reports whether value is nil, a string, a number or a boolean.
+func isScalar(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	switch reflect.TypeOf(value).Kind() {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// sanitizeAnnotationValue coerces value into a type X-Ray accepts as an annotation. Integers of any size become
+// int or uint, and anything else that isn't a string, number or boolean is stringified with fmt.Sprint.
+func sanitizeAnnotationValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case bool, int, uint, float32, float64, string:
+		return v
+	case int8:
+		return int(v)
+	case int16:
+		return int(v)
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case uint8:
+		return uint(v)
+	case uint16:
+		return uint(v)
+	case uint32:
+		return uint(v)
+	case uint64:
+		return uint(v)
+	}
+	return fmt.Sprint(value)
+}
+
 // formatQuery applies a custom query formatter if provided.
 func (p *Plugin) formatQuery(query string) string {
 	if p.queryFormatter != nil {
@@ -159,6 +1727,15 @@ func (p *Plugin) formatQuery(query string) string {
 	return query
 }
 
+// queryPreview collapses the query onto a single line and returns at most its first n characters.
+func queryPreview(query string, n int) string {
+	runes := []rune(strings.Join(strings.Fields(query), " "))
+	if len(runes) > n {
+		runes = runes[:n]
+	}
+	return string(runes)
+}
+
 // dbOperation extracts the first SQL keyword from the query to identify the operation (e.g., SELECT, INSERT).
 func dbOperation(query string) string {
 	s := cCommentRegex.ReplaceAllString(query, "")
@@ -166,3 +1743,97 @@ func dbOperation(query string) string {
 	s = sqlPrefixRegex.ReplaceAllString(s, "")
 	return strings.ToLower(firstWordRegex.FindString(s))
 }
+
+// queryFingerprint normalizes a query into its shape by stripping comments, replacing literals with placeholders,
+// collapsing IN lists and whitespace, so that queries differing only in values share a fingerprint.
+func queryFingerprint(query string) string {
+	s := cCommentRegex.ReplaceAllString(query, "")
+	s = lineCommentRegex.ReplaceAllString(s, "")
+	s = stringLitRegex.ReplaceAllString(s, "?")
+	s = numberLitRegex.ReplaceAllString(s, "?")
+	s = strings.Join(strings.Fields(s), " ")
+	return inListRegex.ReplaceAllString(s, "IN (?)")
+}
+
+// primaryTable returns the statement's table, falling back to the first table named in a FROM, INTO or UPDATE
+// clause for raw queries.
+func primaryTable(tx *gorm.DB) string {
+	if tx.Statement.Table != "" {
+		return tx.Statement.Table
+	}
+	s := cCommentRegex.ReplaceAllString(tx.Statement.SQL.String(), "")
+	s = lineCommentRegex.ReplaceAllString(s, "")
+	if m := tableNameRegex.FindStringSubmatch(s); m != nil {
+		return strings.Trim(m[1], "\"`[]")
+	}
+	return ""
+}
+
+// subsegmentName returns the name the subsegment should be renamed to once the SQL is known, or an empty string
+// to keep the generic callback name. A name template takes precedence over normalized names.
+func (p *Plugin) subsegmentName(tx *gorm.DB) string {
+	if p.nameTemplate != "" {
+		return renderNameTemplate(p.nameTemplate, tx)
+	}
+	if p.normalizeNames {
+		return normalizedName(tx)
+	}
+	return ""
+}
+
+// renderNameTemplate substitutes the {op}, {table} and {engine} placeholders of template. It returns an empty
+// string if a placeholder used by the template can't be resolved for this statement.
+func renderNameTemplate(template string, tx *gorm.DB) string {
+	values := map[string]string{
+		"{op}":     dbOperation(tx.Statement.SQL.String()),
+		"{table}":  primaryTable(tx),
+		"{engine}": tx.Dialector.Name(),
+	}
+	name := template
+	for placeholder, val := range values {
+		if !strings.Contains(name, placeholder) {
+			continue
+		}
+		if val == "" {
+			return ""
+		}
+		name = strings.ReplaceAll(name, placeholder, val)
+	}
+	return name
+}
+
+// normalizedName builds a low-cardinality subsegment name from the query fingerprint's operation and table,
+// e.g. "select users". It returns an empty string if the operation can't be determined.
+func normalizedName(tx *gorm.DB) string {
+	op := dbOperation(queryFingerprint(tx.Statement.SQL.String()))
+	if op == "" {
+		return ""
+	}
+	if table := primaryTable(tx); table != "" {
+		return op + " " + table
+	}
+	return op
+}
+
+// renameSegment replaces the name of an open segment.
+func renameSegment(seg *xray.Segment, name string) {
+	seg.Lock()
+	seg.Name = name
+	seg.Unlock()
+}
+
+// tableAlias extracts the alias of the primary table in a FROM or UPDATE clause, supporting both "users AS u"
+// and bare "users u" forms. It returns an empty string when no alias is present.
+func tableAlias(query string) string {
+	s := cCommentRegex.ReplaceAllString(query, "")
+	s = lineCommentRegex.ReplaceAllString(s, "")
+	m := tableAliasRegex.FindStringSubmatch(s)
+	if m == nil {
+		return ""
+	}
+	alias := strings.Trim(m[1], "\"`")
+	if aliasStopWords[strings.ToLower(alias)] {
+		return ""
+	}
+	return alias
+}
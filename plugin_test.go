@@ -2,11 +2,26 @@ package gormxray
 
 import (
 	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"runtime/debug"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-xray-sdk-go/strategy/sampling"
 	"github.com/aws/aws-xray-sdk-go/xray"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
 )
 
 func TestPluginInitialization(t *testing.T) {
@@ -116,3 +131,3252 @@ func TestIgnoreNonCriticalErrors(t *testing.T) {
 	//	}
 	//}
 }
+
+// alwaysSample is a sampling strategy that traces every request, so subsegments in tests are never dummies.
+type alwaysSample struct{}
+
+func (alwaysSample) ShouldTrace(*sampling.Request) *sampling.Decision {
+	return &sampling.Decision{Sample: true}
+}
+
+func TestMain(m *testing.M) {
+	if err := xray.Configure(xray.Config{SamplingStrategy: alwaysSample{}}); err != nil {
+		log.Fatalf("failed to configure xray: %v", err)
+	}
+	os.Exit(m.Run())
+}
+
+// subsegmentRecorder collects the subsegments traced by the plugin so tests can inspect them.
+type subsegmentRecorder struct {
+	mu   sync.Mutex
+	segs []*xray.Segment
+}
+
+// recordSubsegments registers callbacks that run after the plugin's after hooks and capture the
+// subsegment attached to the statement context.
+func recordSubsegments(t *testing.T, db *gorm.DB) *subsegmentRecorder {
+	t.Helper()
+	rec := &subsegmentRecorder{}
+	record := func(tx *gorm.DB) {
+		seg := xray.GetSegment(tx.Statement.Context)
+		if seg == nil || seg == seg.ParentSegment {
+			return
+		}
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		// Statements that the plugin didn't trace still carry the enclosing subsegment
+		for _, s := range rec.segs {
+			if s == seg {
+				return
+			}
+		}
+		rec.segs = append(rec.segs, seg)
+	}
+
+	cb := db.Callback()
+	registers := map[string]gormRegister{
+		"create": cb.Create().After("xray:after:create"),
+		"select": cb.Query().After("xray:after:select"),
+		"delete": cb.Delete().After("xray:after:delete"),
+		"update": cb.Update().After("xray:after:update"),
+		"row":    cb.Row().After("xray:after:row"),
+		"raw":    cb.Raw().After("xray:after:raw"),
+	}
+	for name, r := range registers {
+		if err := r.Register("test:record:"+name, record); err != nil {
+			t.Fatalf("failed to register recorder: %v", err)
+		}
+	}
+	return rec
+}
+
+// all returns a snapshot of the recorded subsegments.
+func (r *subsegmentRecorder) all() []*xray.Segment {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*xray.Segment(nil), r.segs...)
+}
+
+// last returns the most recently recorded subsegment.
+func (r *subsegmentRecorder) last(t *testing.T) *xray.Segment {
+	t.Helper()
+	segs := r.all()
+	if len(segs) == 0 {
+		t.Fatal("expected at least one subsegment to be recorded, but none found")
+	}
+	return segs[len(segs)-1]
+}
+
+// metadata returns the value recorded under key in the subsegment's default metadata namespace.
+func metadata(seg *xray.Segment, key string) (interface{}, bool) {
+	seg.RLock()
+	defer seg.RUnlock()
+	val, ok := seg.Metadata["default"][key]
+	return val, ok
+}
+
+// failQuery registers a callback that fails every Raw/Exec statement with err before the plugin's after hook runs.
+func failQuery(t *testing.T, db *gorm.DB, err error) {
+	t.Helper()
+	fail := func(tx *gorm.DB) {
+		tx.AddError(err)
+	}
+	if e := db.Callback().Raw().After("gorm:raw").Before("xray:after:raw").Register("test:fail", fail); e != nil {
+		t.Fatalf("failed to register failing callback: %v", e)
+	}
+}
+
+// testUser is a minimal model used by tests that need a real table.
+type testUser struct {
+	ID   uint
+	Name string
+}
+
+// testOrder belongs to a testUser and is used to exercise associations.
+type testOrder struct {
+	ID         uint
+	TestUserID uint
+	Amount     int
+}
+
+// testCustomer is a testUser with its orders, used for Preload.
+type testCustomer struct {
+	ID     uint
+	Name   string
+	Orders []testOrder `gorm:"foreignKey:TestUserID"`
+}
+
+func (testCustomer) TableName() string {
+	return "test_users"
+}
+
+// migrateUsers creates the test_users table and seeds it with the given names.
+func migrateUsers(t *testing.T, db *gorm.DB, names ...string) {
+	t.Helper()
+	if err := db.AutoMigrate(&testUser{}); err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+	for _, name := range names {
+		if err := db.Create(&testUser{Name: name}).Error; err != nil {
+			t.Fatalf("failed to seed user: %v", err)
+		}
+	}
+}
+
+// openTracedDB opens an in-memory SQLite DB with the plugin registered and a root segment on its context.
+func openTracedDB(t *testing.T, opts ...Option) (*gorm.DB, *xray.Segment, *subsegmentRecorder) {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to connect database: %v", err)
+	}
+
+	// A single connection keeps the in-memory database shared across queries
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatalf("failed to get sql.DB: %v", err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+
+	if err := db.Use(NewPlugin(opts...)); err != nil {
+		t.Fatalf("failed to register plugin: %v", err)
+	}
+	rec := recordSubsegments(t, db)
+
+	ctx, rootSegment := xray.BeginSegment(context.Background(), t.Name())
+	t.Cleanup(func() { rootSegment.Close(nil) })
+
+	return db.WithContext(ctx), rootSegment, rec
+}
+
+func TestInheritParentAnnotations(t *testing.T) {
+	db, rootSegment, rec := openTracedDB(t, WithInheritParentAnnotations("tenant", "missing"))
+	rootSegment.AddAnnotation("tenant", "acme")
+	rootSegment.AddAnnotation("region", "eu-west-1")
+
+	var result int
+	if err := db.Raw("SELECT 1").Scan(&result).Error; err != nil {
+		t.Fatalf("failed to execute query: %v", err)
+	}
+
+	seg := rec.last(t)
+	if got := seg.Annotations["tenant"]; got != "acme" {
+		t.Errorf("expected inherited annotation tenant=acme, got %v", got)
+	}
+	if _, ok := seg.Annotations["region"]; ok {
+		t.Error("expected non-configured annotation region not to be inherited")
+	}
+	if _, ok := seg.Annotations["missing"]; ok {
+		t.Error("expected annotation missing from the parent not to be set")
+	}
+}
+
+func TestCapturePlanCache(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithCapturePlanCache(true))
+	db = db.Session(&gorm.Session{PrepareStmt: true})
+
+	var result int
+	for i := 0; i < 2; i++ {
+		if err := db.Raw("SELECT 1").Scan(&result).Error; err != nil {
+			t.Fatalf("failed to execute query: %v", err)
+		}
+	}
+
+	segs := rec.all()
+	if len(segs) != 2 {
+		t.Fatalf("expected 2 subsegments, got %d", len(segs))
+	}
+	if got, _ := metadata(segs[0], "db.plan.cache"); got != "miss" {
+		t.Errorf("expected first run to be a plan cache miss, got %v", got)
+	}
+	if got, _ := metadata(segs[1], "db.plan.cache"); got != "hit" {
+		t.Errorf("expected second run to be a plan cache hit, got %v", got)
+	}
+}
+
+func TestCapturePlanCacheOmittedWithoutPrepareStmt(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithCapturePlanCache(true))
+
+	var result int
+	if err := db.Raw("SELECT 1").Scan(&result).Error; err != nil {
+		t.Fatalf("failed to execute query: %v", err)
+	}
+
+	if _, ok := metadata(rec.last(t), "db.plan.cache"); ok {
+		t.Error("expected db.plan.cache to be omitted when statements aren't prepared")
+	}
+}
+
+func TestFinalMetadataFunc(t *testing.T) {
+	var gotDur time.Duration
+	db, _, rec := openTracedDB(t, WithFinalMetadataFunc(func(tx *gorm.DB, dur time.Duration, err error) map[string]interface{} {
+		gotDur = dur
+		bucket := "fast"
+		if dur > time.Second {
+			bucket = "slow"
+		}
+		return map[string]interface{}{"latency_bucket": bucket}
+	}))
+
+	var result int
+	if err := db.Raw("SELECT 1").Scan(&result).Error; err != nil {
+		t.Fatalf("failed to execute query: %v", err)
+	}
+
+	if gotDur <= 0 {
+		t.Errorf("expected a positive duration, got %v", gotDur)
+	}
+	if got, _ := metadata(rec.last(t), "latency_bucket"); got != "fast" {
+		t.Errorf("expected latency_bucket=fast, got %v", got)
+	}
+}
+
+func TestTableAlias(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"SELECT u.id FROM users AS u JOIN orders o ON o.user_id = u.id", "u"},
+		{"SELECT u.id FROM users u WHERE u.id = 1", "u"},
+		{"SELECT * FROM `users` AS `u`", "u"},
+		{"UPDATE users u SET name = 'x'", "u"},
+		{"SELECT * FROM users WHERE id = 1", ""},
+		{"SELECT * FROM users USE INDEX (idx_name) WHERE id = 1", ""},
+		{"SELECT * FROM users FORCE INDEX (idx_name)", ""},
+		{"SELECT * FROM users WITH (NOLOCK)", ""},
+		{"SELECT id FROM users EXCEPT SELECT id FROM admins", ""},
+		{"SELECT * FROM users", ""},
+		{"SELECT 1", ""},
+	}
+	for _, tt := range tests {
+		if got := tableAlias(tt.query); got != tt.want {
+			t.Errorf("tableAlias(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestCaptureTableAlias(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithCaptureTableAlias(true))
+	if err := db.Exec("CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT)").Error; err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+
+	for _, query := range []string{"SELECT u.id FROM users AS u", "SELECT u.id FROM users u"} {
+		var ids []int
+		if err := db.Raw(query).Scan(&ids).Error; err != nil {
+			t.Fatalf("failed to execute query: %v", err)
+		}
+		if got, _ := metadata(rec.last(t), "db.table.alias"); got != "u" {
+			t.Errorf("expected db.table.alias=u for %q, got %v", query, got)
+		}
+	}
+}
+
+func TestErrorMatcher(t *testing.T) {
+	copyOfEOF := errors.New(io.EOF.Error())
+
+	defaultPlugin := NewPlugin()
+	if !defaultPlugin.isNonCriticalError(fmt.Errorf("scan: %w", sql.ErrNoRows)) {
+		t.Error("expected wrapped sql.ErrNoRows to be non-critical with the default matcher")
+	}
+	if defaultPlugin.isNonCriticalError(copyOfEOF) {
+		t.Error("expected a non-wrapped copy of io.EOF to be critical with the default matcher")
+	}
+
+	byMessage := func(err, target error) bool {
+		return errors.Is(err, target) || err.Error() == target.Error()
+	}
+	customPlugin := NewPlugin(WithErrorMatcher(byMessage))
+	if !customPlugin.isNonCriticalError(copyOfEOF) {
+		t.Error("expected a copy of io.EOF to be non-critical with a custom matcher")
+	}
+	if customPlugin.isNonCriticalError(errors.New("syntax error")) {
+		t.Error("expected an unrelated error to stay critical with a custom matcher")
+	}
+}
+
+func TestQueryPreview(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithQueryPreview(16))
+
+	var result int
+	if err := db.Raw("SELECT\n\t1   AS  first_value\n\tWHERE 1 = 1").Scan(&result).Error; err != nil {
+		t.Fatalf("failed to execute query: %v", err)
+	}
+
+	got, _ := metadata(rec.last(t), "db.query.preview")
+	preview, ok := got.(string)
+	if !ok {
+		t.Fatalf("expected db.query.preview to be a string, got %T", got)
+	}
+	if len(preview) != 16 {
+		t.Errorf("expected preview of 16 characters, got %d (%q)", len(preview), preview)
+	}
+	if strings.ContainsAny(preview, "\n\t") || strings.Contains(preview, "  ") {
+		t.Errorf("expected a single-line preview, got %q", preview)
+	}
+	if preview != "SELECT 1 AS firs" {
+		t.Errorf("unexpected preview %q", preview)
+	}
+}
+
+func TestStats(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to connect database: %v", err)
+	}
+	plugin := NewPlugin()
+	if err := db.Use(plugin); err != nil {
+		t.Fatalf("failed to register plugin: %v", err)
+	}
+
+	ctx, rootSegment := xray.BeginSegment(context.Background(), "TestStats")
+	defer rootSegment.Close(nil)
+	db = db.WithContext(ctx)
+
+	var result int
+	for i := 0; i < 3; i++ {
+		if err := db.Raw("SELECT 1").Scan(&result).Error; err != nil {
+			t.Fatalf("failed to execute query: %v", err)
+		}
+	}
+
+	stats := plugin.Stats()
+	if stats.Traced != 3 {
+		t.Errorf("expected 3 traced queries, got %d", stats.Traced)
+	}
+	if stats.Skipped != 0 {
+		t.Errorf("expected no skipped queries, got %d", stats.Skipped)
+	}
+}
+
+func TestStatsSkipped(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to connect database: %v", err)
+	}
+	plugin := NewPlugin(WithTableAllowlist("test_orders"))
+	if err := db.Use(plugin); err != nil {
+		t.Fatalf("failed to register plugin: %v", err)
+	}
+
+	ctx, rootSegment := xray.BeginSegment(context.Background(), "TestStatsSkipped")
+	defer rootSegment.Close(nil)
+	db = db.WithContext(ctx)
+	if err := db.AutoMigrate(&testUser{}, &testOrder{}); err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+	before := plugin.Stats()
+
+	var users []testUser
+	for i := 0; i < 3; i++ {
+		if err := db.Find(&users).Error; err != nil {
+			t.Fatalf("failed to query users: %v", err)
+		}
+	}
+	var orders []testOrder
+	if err := db.Find(&orders).Error; err != nil {
+		t.Fatalf("failed to query orders: %v", err)
+	}
+
+	stats := plugin.Stats()
+	if got := stats.Skipped - before.Skipped; got != 3 {
+		t.Errorf("expected the 3 queries on test_users to be skipped, got %d", got)
+	}
+	if got := stats.Traced - before.Traced; got != 1 {
+		t.Errorf("expected the query on test_orders to be traced, got %d", got)
+	}
+}
+
+func TestDeadlinePressureRatio(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithDeadlinePressureRatio(0.5))
+	err := db.Callback().Row().After("xray:before:row").Before("gorm:row").Register("test:slow", func(tx *gorm.DB) {
+		time.Sleep(60 * time.Millisecond)
+	})
+	if err != nil {
+		t.Fatalf("failed to register slow callback: %v", err)
+	}
+
+	var result int
+	if err := db.Raw("SELECT 1").Scan(&result).Error; err != nil {
+		t.Fatalf("failed to execute query: %v", err)
+	}
+	if _, ok := rec.last(t).Annotations["db.deadline_pressure"]; ok {
+		t.Error("expected no deadline pressure annotation without a deadline")
+	}
+
+	ctx, cancel := context.WithTimeout(db.Statement.Context, 100*time.Millisecond)
+	defer cancel()
+	if err := db.WithContext(ctx).Raw("SELECT 1").Scan(&result).Error; err != nil {
+		t.Fatalf("failed to execute query: %v", err)
+	}
+	if got := rec.last(t).Annotations["db.deadline_pressure"]; got != true {
+		t.Errorf("expected db.deadline_pressure=true, got %v", got)
+	}
+}
+
+func TestRowsAffected(t *testing.T) {
+	db, _, rec := openTracedDB(t)
+	migrateUsers(t, db, "alice", "bob", "carol")
+
+	if err := db.Model(&testUser{}).Where("name <> ?", "carol").Update("name", "dave").Error; err != nil {
+		t.Fatalf("failed to update: %v", err)
+	}
+	if got, _ := metadata(rec.last(t), "db.rows.affected"); got != int64(2) {
+		t.Errorf("expected db.rows.affected=2, got %v", got)
+	}
+
+	// The Row path never exposes an sql.Result, so the count is genuinely unknown
+	var id int
+	if err := db.Raw("UPDATE test_users SET name = ? WHERE name = ? RETURNING id", "erin", "carol").Row().Scan(&id); err != nil {
+		t.Fatalf("failed to update via row: %v", err)
+	}
+	if _, ok := metadata(rec.last(t), "db.rows.affected"); ok {
+		t.Error("expected db.rows.affected to be omitted when unknown")
+	}
+}
+
+func TestQueryFingerprint(t *testing.T) {
+	a := queryFingerprint("SELECT * FROM users WHERE id = 1 AND name = 'alice'")
+	b := queryFingerprint("SELECT *  FROM users\n WHERE id = 42 AND name = 'bob' -- lookup")
+	if a != b {
+		t.Errorf("expected equal fingerprints, got %q and %q", a, b)
+	}
+	if got := queryFingerprint("SELECT * FROM users WHERE id IN (1, 2, 3)"); got != "SELECT * FROM users WHERE id IN (?)" {
+		t.Errorf("unexpected fingerprint for IN list: %q", got)
+	}
+}
+
+func TestDetectNPlusOne(t *testing.T) {
+	db, rootSegment, _ := openTracedDB(t, WithDetectNPlusOne(3))
+	migrateUsers(t, db, "alice", "bob")
+
+	var user testUser
+	if err := db.First(&user, 1).Error; err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+	if _, ok := rootSegment.Annotations["db.nplus1.detected"]; ok {
+		t.Fatal("expected no N+1 detection below the threshold")
+	}
+
+	for i := 0; i < 5; i++ {
+		var u testUser
+		if err := db.Where("id = ?", i).Limit(1).Find(&u).Error; err != nil {
+			t.Fatalf("failed to query: %v", err)
+		}
+	}
+
+	if got := rootSegment.Annotations["db.nplus1.detected"]; got != true {
+		t.Errorf("expected db.nplus1.detected=true, got %v", got)
+	}
+	query, _ := rootSegment.Annotations["db.nplus1.query"].(string)
+	if !strings.Contains(query, "test_users") {
+		t.Errorf("expected db.nplus1.query to contain the repeated query, got %q", query)
+	}
+}
+
+func TestDetectNPlusOneWithMinDurationToRecord(t *testing.T) {
+	db, rootSegment, _ := openTracedDB(t, WithDetectNPlusOne(3), WithMinDurationToRecord(time.Hour))
+	migrateUsers(t, db, "alice", "bob")
+
+	for i := 0; i < 5; i++ {
+		var u testUser
+		if err := db.Where("id = ?", i).Limit(1).Find(&u).Error; err != nil {
+			t.Fatalf("failed to query: %v", err)
+		}
+	}
+
+	if got := rootSegment.Annotations["db.nplus1.detected"]; got != true {
+		t.Errorf("expected db.nplus1.detected=true for discarded fast queries, got %v", got)
+	}
+}
+
+// execWithoutSegment runs query n times through p on a context without a segment, so each statement gets its own
+// fallback parent segment. Errors are ignored.
+func execWithoutSegment(t *testing.T, p *Plugin, n int, query string) {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to connect database: %v", err)
+	}
+	if err := db.Use(p); err != nil {
+		t.Fatalf("failed to register plugin: %v", err)
+	}
+	for i := 0; i < n; i++ {
+		_ = db.Exec(query).Error
+	}
+}
+
+func TestDetectNPlusOneSkipsFallbackParents(t *testing.T) {
+	p := NewPlugin(WithDetectNPlusOne(3))
+	execWithoutSegment(t, p, 2000, "SELECT 1")
+	if got := p.nPlusOne.runs.len(); got != 0 {
+		t.Errorf("expected fallback parents not to be tracked, got %d", got)
+	}
+}
+
+func TestSuppressDuplicateErrorsSkipsFallbackParents(t *testing.T) {
+	p := NewPlugin(WithSuppressDuplicateErrors(true))
+	execWithoutSegment(t, p, 2000, "SELEC 1")
+	p.duplicateErrors.mu.Lock()
+	defer p.duplicateErrors.mu.Unlock()
+	if got := p.duplicateErrors.seen.len(); got != 0 {
+		t.Errorf("expected fallback parents not to be tracked, got %d", got)
+	}
+}
+
+func TestParentStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	store := newParentStore[int]()
+	parents := make([]*xray.Segment, maxTrackedParents+1)
+	for i := range parents {
+		parents[i] = &xray.Segment{}
+	}
+	for _, parent := range parents[:maxTrackedParents] {
+		v, _ := store.get(parent)
+		*v = 1
+	}
+	// Touch the oldest parent, so the second one becomes the least recently used
+	if v, ok := store.get(parents[0]); !ok || *v != 1 {
+		t.Fatalf("expected the first parent to be tracked, got %v, %v", *v, ok)
+	}
+	store.get(parents[maxTrackedParents])
+
+	if got := store.len(); got != maxTrackedParents {
+		t.Errorf("expected the store to be capped at %d parents, got %d", maxTrackedParents, got)
+	}
+	if _, ok := store.items[parents[1]]; ok {
+		t.Error("expected the least recently used parent to be evicted")
+	}
+	if _, ok := store.items[parents[0]]; !ok {
+		t.Error("expected a recently used parent to be kept")
+	}
+}
+
+func TestCompactMetadata(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithCompactMetadata(true))
+	migrateUsers(t, db, "alice")
+
+	if err := db.Model(&testUser{}).Where("name = ?", "alice").Update("name", "bob").Error; err != nil {
+		t.Fatalf("failed to update: %v", err)
+	}
+
+	seg := rec.last(t)
+	if _, ok := metadata(seg, "db.query"); ok {
+		t.Error("expected no separate db.query key in compact mode")
+	}
+	val, _ := metadata(seg, "db")
+	obj, ok := val.(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected db metadata to be an object, got %T", val)
+	}
+	if obj["operation"] != "update" {
+		t.Errorf("expected operation=update, got %v", obj["operation"])
+	}
+	if obj["table"] != "test_users" {
+		t.Errorf("expected table=test_users, got %v", obj["table"])
+	}
+	if obj["rows_affected"] != int64(1) {
+		t.Errorf("expected rows_affected=1, got %v", obj["rows_affected"])
+	}
+	if query, _ := obj["query"].(string); !strings.HasPrefix(query, "UPDATE") {
+		t.Errorf("expected query to be recorded, got %v", obj["query"])
+	}
+	if dur, ok := obj["duration_ms"].(float64); !ok || dur < 0 {
+		t.Errorf("expected a non-negative duration_ms, got %v", obj["duration_ms"])
+	}
+}
+
+// stateError is a driver-style error exposing a SQLSTATE code.
+type stateError struct {
+	code string
+}
+
+func (e *stateError) Error() string    { return "driver error " + e.code }
+func (e *stateError) SQLState() string { return e.code }
+
+func TestRecordSQLState(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithRecordSQLState(true))
+	failQuery(t, db, fmt.Errorf("exec: %w", &stateError{code: "23505"}))
+
+	if err := db.Exec("SELECT 1").Error; err == nil {
+		t.Fatal("expected the query to fail")
+	}
+
+	seg := rec.last(t)
+	if !seg.Fault {
+		t.Error("expected the subsegment to record a fault")
+	}
+	if got := seg.Annotations["db.sqlstate"]; got != "23505" {
+		t.Errorf("expected db.sqlstate=23505, got %v", got)
+	}
+}
+
+func TestFlattenPreloads(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithFlattenPreloads(true))
+	migrateUsers(t, db, "alice")
+	if err := db.AutoMigrate(&testOrder{}); err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+	if err := db.Create(&testOrder{TestUserID: 1, Amount: 10}).Error; err != nil {
+		t.Fatalf("failed to seed order: %v", err)
+	}
+
+	before := len(rec.all())
+	var customers []testCustomer
+	if err := db.Preload("Orders").Find(&customers).Error; err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+	if len(customers) != 1 || len(customers[0].Orders) != 1 {
+		t.Fatalf("expected preloaded orders, got %+v", customers)
+	}
+
+	segs := rec.all()[before:]
+	if len(segs) != 1 {
+		t.Fatalf("expected a single subsegment for the preloading query, got %d", len(segs))
+	}
+	val, _ := metadata(segs[0], "db.preloads")
+	preloads, ok := val.([]string)
+	if !ok || len(preloads) != 1 {
+		t.Fatalf("expected one flattened preload query, got %v", val)
+	}
+	if !strings.Contains(preloads[0], "test_orders") {
+		t.Errorf("expected preload query on test_orders, got %q", preloads[0])
+	}
+}
+
+func TestAnnotationValueSanitizer(t *testing.T) {
+	_, seg := xray.BeginSegment(context.Background(), "TestAnnotationValueSanitizer")
+	defer seg.Close(nil)
+
+	type tenant struct {
+		ID   int
+		Name string
+	}
+
+	plugin := NewPlugin()
+	plugin.addAnnotation(seg, "tenant", tenant{ID: 7, Name: "acme"})
+	plugin.addAnnotation(seg, "rows", int64(42))
+	if got := seg.Annotations["tenant"]; got != "{7 acme}" {
+		t.Errorf("expected struct annotation to be stringified, got %v", got)
+	}
+	if got := seg.Annotations["rows"]; got != 42 {
+		t.Errorf("expected int64 annotation to be kept as a number, got %v (%T)", got, got)
+	}
+
+	custom := NewPlugin(WithAnnotationValueSanitizer(func(v interface{}) interface{} {
+		return fmt.Sprintf("%+v", v)
+	}))
+	custom.addAnnotation(seg, "tenant", tenant{ID: 7, Name: "acme"})
+	if got := seg.Annotations["tenant"]; got != "{ID:7 Name:acme}" {
+		t.Errorf("expected custom sanitizer to be applied, got %v", got)
+	}
+}
+
+func TestCaptureResultCount(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithCaptureResultCount(true))
+	migrateUsers(t, db, "alice", "bob", "carol")
+
+	var users []testUser
+	if err := db.Find(&users).Error; err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+	if got, _ := metadata(rec.last(t), "db.result.count"); got != 3 {
+		t.Errorf("expected db.result.count=3, got %v", got)
+	}
+
+	var user testUser
+	if err := db.Where("name = ?", "bob").Find(&user).Error; err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+	if got, _ := metadata(rec.last(t), "db.result.count"); got != 1 {
+		t.Errorf("expected db.result.count=1 for a found struct, got %v", got)
+	}
+
+	var missing testUser
+	if err := db.Where("name = ?", "nobody").Find(&missing).Error; err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+	if got, _ := metadata(rec.last(t), "db.result.count"); got != 0 {
+		t.Errorf("expected db.result.count=0 for an empty struct, got %v", got)
+	}
+}
+
+func TestStatementTimeoutMetadata(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithStatementTimeoutMetadata(true))
+
+	var result int
+	if err := db.Raw("SELECT 1").Scan(&result).Error; err != nil {
+		t.Fatalf("failed to execute query: %v", err)
+	}
+	if _, ok := metadata(rec.last(t), "db.statement_timeout_ms"); ok {
+		t.Error("expected db.statement_timeout_ms to be omitted without a deadline")
+	}
+
+	ctx, cancel := context.WithTimeout(db.Statement.Context, 5*time.Second)
+	defer cancel()
+	if err := db.WithContext(ctx).Raw("SELECT 1").Scan(&result).Error; err != nil {
+		t.Fatalf("failed to execute query: %v", err)
+	}
+	got, _ := metadata(rec.last(t), "db.statement_timeout_ms")
+	timeout, ok := got.(int64)
+	if !ok || timeout <= 4000 || timeout > 5000 {
+		t.Errorf("expected db.statement_timeout_ms close to 5000, got %v", got)
+	}
+}
+
+func TestBaseContext(t *testing.T) {
+	type jobKey struct{}
+	base := context.WithValue(context.Background(), jobKey{}, "nightly-report")
+
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to connect database: %v", err)
+	}
+	if err := db.Use(NewPlugin(WithBaseContext(base))); err != nil {
+		t.Fatalf("failed to register plugin: %v", err)
+	}
+
+	var seen interface{}
+	err = db.Callback().Row().After("xray:after:row").Register("test:inspect", func(tx *gorm.DB) {
+		seen = tx.Statement.Context.Value(jobKey{})
+	})
+	if err != nil {
+		t.Fatalf("failed to register callback: %v", err)
+	}
+
+	// No parent segment on the context, so the plugin creates the fallback segment
+	var result int
+	if err := db.WithContext(context.Background()).Raw("SELECT 1").Scan(&result).Error; err != nil {
+		t.Fatalf("failed to execute query: %v", err)
+	}
+	if seen != "nightly-report" {
+		t.Errorf("expected base context value to be reachable in after(), got %v", seen)
+	}
+}
+
+func TestQueryNormalizationForNames(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithQueryNormalizationForNames(true))
+	migrateUsers(t, db, "alice", "bob")
+
+	var names []string
+	for _, id := range []int{1, 2} {
+		var user testUser
+		if err := db.Raw(fmt.Sprintf("SELECT * FROM test_users WHERE id = %d", id)).Scan(&user).Error; err != nil {
+			t.Fatalf("failed to query: %v", err)
+		}
+		names = append(names, rec.last(t).Name)
+	}
+
+	if names[0] != names[1] {
+		t.Errorf("expected shape-identical queries to share a name, got %q and %q", names[0], names[1])
+	}
+	if names[0] != "select test_users" {
+		t.Errorf("expected name %q, got %q", "select test_users", names[0])
+	}
+
+	var users []testUser
+	if err := db.Where("name = ?", "alice").Find(&users).Error; err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+	if got := rec.last(t).Name; got != "select test_users" {
+		t.Errorf("expected name %q for a Find, got %q", "select test_users", got)
+	}
+}
+
+func TestAnnotationAllowlist(t *testing.T) {
+	db, rootSegment, rec := openTracedDB(t,
+		WithInheritParentAnnotations("tenant", "region"),
+		WithDeadlinePressureRatio(0.0001),
+		WithAnnotationAllowlist("tenant"),
+	)
+	rootSegment.AddAnnotation("tenant", "acme")
+	rootSegment.AddAnnotation("region", "eu-west-1")
+
+	ctx, cancel := context.WithTimeout(db.Statement.Context, time.Millisecond)
+	defer cancel()
+	var result int
+	if err := db.WithContext(ctx).Raw("SELECT 1").Scan(&result).Error; err != nil {
+		t.Fatalf("failed to execute query: %v", err)
+	}
+
+	seg := rec.last(t)
+	if got := seg.Annotations["tenant"]; got != "acme" {
+		t.Errorf("expected allowlisted annotation tenant=acme, got %v", got)
+	}
+	for _, key := range []string{"region", "db.deadline_pressure"} {
+		if _, ok := seg.Annotations[key]; ok {
+			t.Errorf("expected %s not to be an annotation", key)
+		}
+		if _, ok := metadata(seg, key); !ok {
+			t.Errorf("expected %s to be downgraded to metadata", key)
+		}
+	}
+}
+
+func TestMinDurationToRecord(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithMinDurationToRecord(time.Hour))
+
+	var result int
+	if err := db.Raw("SELECT 1").Scan(&result).Error; err != nil {
+		t.Fatalf("failed to execute query: %v", err)
+	}
+	seg := rec.last(t)
+	if _, ok := metadata(seg, "db.query"); ok {
+		t.Error("expected metadata to be skipped for a query below the minimum duration")
+	}
+
+	failQuery(t, db, errors.New("boom"))
+	if err := db.Exec("SELECT 1").Error; err == nil {
+		t.Fatal("expected the query to fail")
+	}
+	seg = rec.last(t)
+	if _, ok := metadata(seg, "db.query"); !ok {
+		t.Error("expected failed queries to be recorded regardless of duration")
+	}
+	if !seg.Fault {
+		t.Error("expected the failed query to record a fault")
+	}
+}
+
+func TestNameTemplate(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithNameTemplate("db.{table}.{op}"))
+	migrateUsers(t, db)
+
+	var users []testUser
+	if err := db.Find(&users).Error; err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+	if got := rec.last(t).Name; got != "db.test_users.select" {
+		t.Errorf("expected name %q, got %q", "db.test_users.select", got)
+	}
+
+	// No table to render, so the generic name is kept
+	var result int
+	if err := db.Raw("SELECT 1").Scan(&result).Error; err != nil {
+		t.Fatalf("failed to execute query: %v", err)
+	}
+	if got := rec.last(t).Name; got != "gorm.Row" {
+		t.Errorf("expected generic name gorm.Row, got %q", got)
+	}
+}
+
+func TestErrorSampling(t *testing.T) {
+	tests := []struct {
+		rate      float64
+		wantFault bool
+	}{
+		{rate: 0, wantFault: false},
+		{rate: 1, wantFault: true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.rate), func(t *testing.T) {
+			db, _, rec := openTracedDB(t, WithErrorSampling(tt.rate))
+			failQuery(t, db, errors.New("boom"))
+
+			for i := 0; i < 5; i++ {
+				if err := db.Exec("SELECT 1").Error; err == nil {
+					t.Fatal("expected the query to fail")
+				}
+			}
+
+			segs := rec.all()
+			if len(segs) != 5 {
+				t.Fatalf("expected 5 subsegments, got %d", len(segs))
+			}
+			for _, seg := range segs {
+				if seg.Fault != tt.wantFault {
+					t.Errorf("expected fault=%v, got %v", tt.wantFault, seg.Fault)
+				}
+				if _, ok := metadata(seg, "db.error"); ok == tt.wantFault {
+					t.Errorf("expected db.error metadata only for unsampled errors (fault=%v)", seg.Fault)
+				}
+			}
+		})
+	}
+}
+
+func TestCaptureBackendPID(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithCaptureBackendPID(true))
+	migrateUsers(t, db)
+
+	query := backendPIDQuery(db.Dialector.Name())
+	err := db.Transaction(func(tx *gorm.DB) error {
+		return tx.Create(&testUser{Name: "alice"}).Error
+	})
+	if err != nil {
+		t.Fatalf("failed to run transaction: %v", err)
+	}
+
+	pid, ok := metadata(rec.last(t), "db.backend_pid")
+	if query == "" {
+		if ok {
+			t.Errorf("expected db.backend_pid to be omitted on %s, got %v", db.Dialector.Name(), pid)
+		}
+		t.Skipf("backend PID is not supported on %s", db.Dialector.Name())
+	}
+	if !ok || pid == "" {
+		t.Error("expected db.backend_pid to be recorded")
+	}
+}
+
+func TestBackendPIDCachedPerConnection(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to connect database: %v", err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatalf("failed to get sql.DB: %v", err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	cache := newConnCache()
+
+	for i := 0; i < 5; i++ {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if _, ok := cache.lookup(tx, "SELECT 1"); !ok {
+				return errors.New("lookup failed")
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("failed to run transaction: %v", err)
+		}
+	}
+	if got := len(cache.values); got != 1 {
+		t.Errorf("expected transactions on one connection to share 1 lookup, got %d", got)
+	}
+
+	busy := newConnCache()
+	err = db.Transaction(func(tx *gorm.DB) error {
+		tx.Statement.Dest = &sql.Rows{}
+		if _, ok := busy.lookup(tx, "SELECT 1"); ok {
+			t.Error("expected no lookup while the statement's rows are open")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to run transaction: %v", err)
+	}
+}
+
+func TestGroupByModel(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithGroupByModel(true))
+	migrateUsers(t, db, "alice")
+
+	var users []testUser
+	if err := db.Find(&users).Error; err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+	if got := rec.last(t).Annotations["model"]; got != "testUser" {
+		t.Errorf("expected model=testUser, got %v", got)
+	}
+
+	var result int
+	if err := db.Raw("SELECT 1").Scan(&result).Error; err != nil {
+		t.Fatalf("failed to execute query: %v", err)
+	}
+	if _, ok := rec.last(t).Annotations["model"]; ok {
+		t.Error("expected no model annotation for a raw query")
+	}
+}
+
+func TestContextSwapClosesSubsegment(t *testing.T) {
+	db, _, _ := openTracedDB(t)
+
+	var subSegment *xray.Segment
+	swap := func(tx *gorm.DB) {
+		subSegment = xray.GetSegment(tx.Statement.Context)
+		// Simulate a buggy callback replacing the context with an unrelated segment
+		var unrelated *xray.Segment
+		tx.Statement.Context, unrelated = xray.BeginSegment(context.Background(), "Unrelated")
+		t.Cleanup(func() { unrelated.Close(nil) })
+	}
+	if err := db.Callback().Row().After("xray:before:row").Before("gorm:row").Register("test:swap", swap); err != nil {
+		t.Fatalf("failed to register swap callback: %v", err)
+	}
+
+	var logs strings.Builder
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	var result int
+	if err := db.Raw("SELECT 1").Scan(&result).Error; err != nil {
+		t.Fatalf("failed to execute query: %v", err)
+	}
+
+	if subSegment == nil {
+		t.Fatal("expected the before hook to start a subsegment")
+	}
+	subSegment.RLock()
+	inProgress := subSegment.InProgress
+	subSegment.RUnlock()
+	if inProgress {
+		t.Error("expected the stored subsegment to be closed despite the context swap")
+	}
+	if !strings.Contains(logs.String(), "[WARN] Statement context was replaced") {
+		t.Errorf("expected a warning about the context swap, got %q", logs.String())
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to connect database: %v", err)
+	}
+	plugin := NewPlugin(WithRateLimiter(2))
+	if err := db.Use(plugin); err != nil {
+		t.Fatalf("failed to register plugin: %v", err)
+	}
+
+	ctx, rootSegment := xray.BeginSegment(context.Background(), "TestRateLimiter")
+	defer rootSegment.Close(nil)
+	db = db.WithContext(ctx)
+
+	var result int
+	for i := 0; i < 10; i++ {
+		if err := db.Raw("SELECT 1").Scan(&result).Error; err != nil {
+			t.Fatalf("failed to execute query: %v", err)
+		}
+	}
+
+	stats := plugin.Stats()
+	if stats.Traced+stats.Dropped != 10 {
+		t.Errorf("expected traced+dropped=10, got %d+%d", stats.Traced, stats.Dropped)
+	}
+	if stats.Dropped < 7 {
+		t.Errorf("expected most of the burst to be dropped, got %d dropped", stats.Dropped)
+	}
+}
+
+func TestUppercaseOperationVerb(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithUppercaseOperationVerb(true))
+
+	var result int
+	if err := db.Raw("select 1").Scan(&result).Error; err != nil {
+		t.Fatalf("failed to execute query: %v", err)
+	}
+
+	seg := rec.last(t)
+	if got, _ := metadata(seg, "db.operation"); got != "select" {
+		t.Errorf("expected db.operation=select, got %v", got)
+	}
+	if got, _ := metadata(seg, "db.operation.verb"); got != "SELECT" {
+		t.Errorf("expected db.operation.verb=SELECT, got %v", got)
+	}
+}
+
+func TestCaptureOrderByAndLimit(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithCaptureOrderBy(true), WithCaptureLimit(true))
+	migrateUsers(t, db, "alice", "bob")
+
+	var users []testUser
+	if err := db.Order("name desc").Limit(10).Find(&users).Error; err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+
+	seg := rec.last(t)
+	orderBy, _ := metadata(seg, "db.order_by")
+	if columns, ok := orderBy.([]string); !ok || len(columns) != 1 || columns[0] != "name desc" {
+		t.Errorf("expected db.order_by=[name desc], got %v", orderBy)
+	}
+	if got, _ := metadata(seg, "db.limit"); got != "LIMIT ?" {
+		t.Errorf("expected masked db.limit, got %v", got)
+	}
+
+	if err := db.Find(&users).Error; err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+	seg = rec.last(t)
+	if _, ok := metadata(seg, "db.order_by"); ok {
+		t.Error("expected db.order_by to be omitted without ORDER BY")
+	}
+	if _, ok := metadata(seg, "db.limit"); ok {
+		t.Error("expected db.limit to be omitted without LIMIT")
+	}
+}
+
+func TestSetEnabled(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to connect database: %v", err)
+	}
+	plugin := NewPlugin(WithEnabled(false))
+	if err := db.Use(plugin); err != nil {
+		t.Fatalf("failed to register plugin: %v", err)
+	}
+	rec := recordSubsegments(t, db)
+
+	ctx, rootSegment := xray.BeginSegment(context.Background(), "TestSetEnabled")
+	defer rootSegment.Close(nil)
+	db = db.WithContext(ctx)
+
+	query := func() {
+		t.Helper()
+		var result int
+		if err := db.Raw("SELECT 1").Scan(&result).Error; err != nil {
+			t.Fatalf("failed to execute query: %v", err)
+		}
+	}
+
+	query()
+	if n := len(rec.all()); n != 0 {
+		t.Fatalf("expected no subsegments while disabled, got %d", n)
+	}
+
+	plugin.SetEnabled(true)
+	query()
+	if n := len(rec.all()); n != 1 {
+		t.Fatalf("expected a subsegment once enabled, got %d", n)
+	}
+
+	plugin.SetEnabled(false)
+	query()
+	if n := len(rec.all()); n != 1 {
+		t.Fatalf("expected no new subsegments after disabling, got %d", n)
+	}
+
+	if stats := plugin.Stats(); stats.Traced != 1 || stats.Skipped != 2 {
+		t.Errorf("expected 1 traced and 2 skipped, got %+v", stats)
+	}
+}
+
+// dsnConnector adapts a driver and DSN to driver.Connector.
+type dsnConnector struct {
+	dsn string
+	drv driver.Driver
+}
+
+func (c dsnConnector) Connect(context.Context) (driver.Conn, error) { return c.drv.Open(c.dsn) }
+func (c dsnConnector) Driver() driver.Driver                        { return c.drv }
+
+// segmentRecordingConnector records the segment active on the context of every Connect call.
+type segmentRecordingConnector struct {
+	driver.Connector
+	mu   sync.Mutex
+	segs []*xray.Segment
+}
+
+func (c *segmentRecordingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	c.mu.Lock()
+	c.segs = append(c.segs, xray.GetSegment(ctx))
+	c.mu.Unlock()
+	return c.Connector.Connect(ctx)
+}
+
+func TestInstrumentConnPool(t *testing.T) {
+	sqliteDB, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("failed to open sqlite: %v", err)
+	}
+	defer sqliteDB.Close()
+
+	inner := &segmentRecordingConnector{Connector: dsnConnector{dsn: ":memory:", drv: sqliteDB.Driver()}}
+	sqlDB := sql.OpenDB(InstrumentConnector(inner))
+	defer sqlDB.Close()
+	// Without idle connections, every query has to dial a fresh one
+	sqlDB.SetMaxIdleConns(0)
+
+	db, err := gorm.Open(sqlite.Dialector{Conn: sqlDB}, &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to connect database: %v", err)
+	}
+	if err := db.Use(NewPlugin(WithInstrumentConnPool(true))); err != nil {
+		t.Fatalf("failed to register plugin: %v", err)
+	}
+
+	ctx, rootSegment := xray.BeginSegment(context.Background(), "TestInstrumentConnPool")
+	defer rootSegment.Close(nil)
+
+	var result int
+	if err := db.WithContext(ctx).Raw("SELECT 1").Scan(&result).Error; err != nil {
+		t.Fatalf("failed to execute query: %v", err)
+	}
+
+	inner.mu.Lock()
+	defer inner.mu.Unlock()
+	if len(inner.segs) == 0 {
+		t.Fatal("expected the pool to dial a fresh connection")
+	}
+	seg := inner.segs[len(inner.segs)-1]
+	if seg == nil || seg.Name != "db.connect" {
+		t.Fatalf("expected the dial to run inside a db.connect subsegment, got %+v", seg)
+	}
+	seg.RLock()
+	defer seg.RUnlock()
+	if seg.InProgress {
+		t.Error("expected the db.connect subsegment to be closed")
+	}
+}
+
+func TestInstrumentConnPoolNamespace(t *testing.T) {
+	for connectorNamespace, traced := range map[string]bool{"a": true, "b": false} {
+		sqliteDB, err := sql.Open("sqlite3", ":memory:")
+		if err != nil {
+			t.Fatalf("failed to open sqlite: %v", err)
+		}
+		defer sqliteDB.Close()
+
+		inner := &segmentRecordingConnector{Connector: dsnConnector{dsn: ":memory:", drv: sqliteDB.Driver()}}
+		sqlDB := sql.OpenDB(InstrumentConnector(inner, WithInstanceKeyNamespace(connectorNamespace)))
+		defer sqlDB.Close()
+		sqlDB.SetMaxIdleConns(0)
+
+		db, err := gorm.Open(sqlite.Dialector{Conn: sqlDB}, &gorm.Config{})
+		if err != nil {
+			t.Fatalf("failed to connect database: %v", err)
+		}
+		if err := db.Use(NewPlugin(WithInstrumentConnPool(true), WithInstanceKeyNamespace("a"))); err != nil {
+			t.Fatalf("failed to register plugin: %v", err)
+		}
+
+		ctx, rootSegment := xray.BeginSegment(context.Background(), t.Name())
+		var result int
+		if err := db.WithContext(ctx).Raw("SELECT 1").Scan(&result).Error; err != nil {
+			t.Fatalf("failed to execute query: %v", err)
+		}
+		rootSegment.Close(nil)
+
+		inner.mu.Lock()
+		seg := inner.segs[len(inner.segs)-1]
+		inner.mu.Unlock()
+		if got := seg != nil && seg.Name == "db.connect"; got != traced {
+			t.Errorf("connector namespace %q: expected dial traced=%v, got %v", connectorNamespace, traced, got)
+		}
+	}
+}
+
+func TestCaptureVarTypes(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithCaptureVarTypes(true), WithExcludeQueryVars(true))
+
+	if err := db.Exec("SELECT ?, ?, ?", 42, "alice", time.Now()).Error; err != nil {
+		t.Fatalf("failed to execute query: %v", err)
+	}
+
+	seg := rec.last(t)
+	if got, _ := metadata(seg, "db.vars.types"); got != "[int,string,time.Time]" {
+		t.Errorf("expected db.vars.types=[int,string,time.Time], got %v", got)
+	}
+	if got, _ := metadata(seg, "db.query"); strings.Contains(fmt.Sprint(got), "alice") {
+		t.Errorf("expected query vars to stay excluded, got %v", got)
+	}
+}
+
+func TestDetailOnError(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithExcludeQueryVars(true), WithDetailOnError(true))
+
+	if err := db.Exec("SELECT ?", "alice").Error; err != nil {
+		t.Fatalf("failed to execute query: %v", err)
+	}
+	seg := rec.last(t)
+	if got, _ := metadata(seg, "db.query"); got != "SELECT ?" {
+		t.Errorf("expected a minimal query for a successful statement, got %v", got)
+	}
+	if _, ok := metadata(seg, "db.caller"); ok {
+		t.Error("expected db.caller to be omitted for a successful statement")
+	}
+
+	failQuery(t, db, errors.New("boom"))
+	_ = db.Exec("SELECT ?", "alice").Error
+	seg = rec.last(t)
+	if got, _ := metadata(seg, "db.query"); !strings.Contains(fmt.Sprint(got), `"alice"`) {
+		t.Errorf("expected the failed query to be recorded with its vars, got %v", got)
+	}
+	if got, _ := metadata(seg, "db.caller"); !strings.Contains(fmt.Sprint(got), "plugin_test.go:") {
+		t.Errorf("expected db.caller to point at the test, got %v", got)
+	}
+}
+
+func TestVersionMetadata(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithVersionMetadata(true))
+	migrateUsers(t, db, "alice")
+
+	var users []testUser
+	for i := 0; i < 2; i++ {
+		if err := db.Find(&users).Error; err != nil {
+			t.Fatalf("failed to query: %v", err)
+		}
+	}
+
+	count := 0
+	for _, seg := range rec.all() {
+		if _, ok := metadata(seg, "gormxray.version"); ok {
+			count++
+			if got, _ := metadata(seg, "gorm.version"); got != "v1.25.12" {
+				t.Errorf("expected gorm.version=v1.25.12, got %v", got)
+			}
+		}
+	}
+	if count != 1 {
+		t.Errorf("expected version metadata on exactly one subsegment, got %d", count)
+	}
+}
+
+func TestBuildInfoVersion(t *testing.T) {
+	info := &debug.BuildInfo{
+		Main: debug.Module{Path: "example.com/app"},
+		Deps: []*debug.Module{
+			{Path: "gorm.io/gorm", Version: "v1.25.12"},
+			{Path: modulePath, Version: "v1.2.0", Replace: &debug.Module{Path: "../gormxray"}},
+			{Path: "example.com/forked", Version: "v1.0.0", Replace: &debug.Module{Path: "example.com/fork", Version: "v1.0.1"}},
+		},
+	}
+	for path, want := range map[string]string{
+		"example.com/app":    "(devel)",
+		"gorm.io/gorm":       "v1.25.12",
+		modulePath:           "v1.2.0",
+		"example.com/forked": "v1.0.1",
+		"example.com/absent": "unknown",
+	} {
+		if got := buildInfoVersion(info, path); got != want {
+			t.Errorf("buildInfoVersion(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestVersionMetadataFallbackParents(t *testing.T) {
+	p := NewPlugin(WithVersionMetadata(true), WithCaptureNamingStrategy(true))
+	execWithoutSegment(t, p, 2000, "SELECT 1")
+	if got := p.versionMetadata.seen.len(); got != 0 {
+		t.Errorf("expected fallback parents not to be tracked for version metadata, got %d", got)
+	}
+	if got := p.namingStrategyOnce.seen.len(); got != 0 {
+		t.Errorf("expected fallback parents not to be tracked for the naming strategy, got %d", got)
+	}
+}
+
+func TestSubsegmentType(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithSubsegmentType("sql"))
+	migrateUsers(t, db, "alice")
+
+	var users []testUser
+	if err := db.Find(&users).Error; err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+	if got := rec.last(t).Type; got != "sql" {
+		t.Errorf("expected subsegment type sql, got %q", got)
+	}
+
+	db, _, rec = openTracedDB(t, WithSubsegmentType("bogus"))
+	migrateUsers(t, db, "alice")
+	if err := db.Find(&users).Error; err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+	if got := rec.last(t).Type; got != "" {
+		t.Errorf("expected an unknown type to be ignored, got %q", got)
+	}
+}
+
+// segmentEmitter is an xray.Emitter that records the segments it is asked to emit.
+type segmentEmitter struct {
+	mu       sync.Mutex
+	segments []*xray.Segment
+}
+
+func (e *segmentEmitter) Emit(seg *xray.Segment) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.segments = append(e.segments, seg)
+}
+
+func (e *segmentEmitter) RefreshEmitterWithAddress(*net.UDPAddr) {}
+
+func TestSubsegmentTypeKeepsParentEmitted(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to connect database: %v", err)
+	}
+	if err := db.Use(NewPlugin(WithSubsegmentType("subsegment"))); err != nil {
+		t.Fatalf("failed to register plugin: %v", err)
+	}
+
+	emitter := &segmentEmitter{}
+	ctx, err := xray.ContextWithConfig(context.Background(), xray.Config{Emitter: emitter})
+	if err != nil {
+		t.Fatalf("failed to configure emitter: %v", err)
+	}
+	ctx, root := xray.BeginSegment(ctx, t.Name())
+	var result int
+	if err := db.WithContext(ctx).Raw("SELECT 1").Scan(&result).Error; err != nil {
+		t.Fatalf("failed to execute query: %v", err)
+	}
+	root.Close(nil)
+
+	emitter.mu.Lock()
+	defer emitter.mu.Unlock()
+	if len(emitter.segments) != 1 || emitter.segments[0] != root {
+		names := make([]string, len(emitter.segments))
+		for i, seg := range emitter.segments {
+			names[i] = seg.Name
+		}
+		t.Errorf("expected only the parent segment to be emitted, got %v", names)
+	}
+}
+
+func TestCacheStatusKey(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithCacheStatusKey("cache:hit"))
+	migrateUsers(t, db, "alice")
+
+	var users []testUser
+	if err := db.Set("cache:hit", true).Find(&users).Error; err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+	if got, _ := metadata(rec.last(t), "db.cache"); got != "hit" {
+		t.Errorf("expected db.cache=hit, got %v", got)
+	}
+
+	if err := db.Find(&users).Error; err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+	if got, _ := metadata(rec.last(t), "db.cache"); got != "miss" {
+		t.Errorf("expected db.cache=miss, got %v", got)
+	}
+}
+
+func TestSlowKeepFastSample(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithSlowKeepFastSample(50*time.Millisecond, 0))
+
+	var result int
+	for i := 0; i < 3; i++ {
+		if err := db.Raw("SELECT 1").Scan(&result).Error; err != nil {
+			t.Fatalf("failed to execute query: %v", err)
+		}
+		if _, ok := metadata(rec.last(t), "db.query"); ok {
+			t.Error("expected fast queries to be dropped at a zero sample rate")
+		}
+	}
+
+	err := db.Callback().Row().After("xray:before:row").Before("gorm:row").Register("test:slow", func(tx *gorm.DB) {
+		time.Sleep(60 * time.Millisecond)
+	})
+	if err != nil {
+		t.Fatalf("failed to register slow callback: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := db.Raw("SELECT 1").Scan(&result).Error; err != nil {
+			t.Fatalf("failed to execute query: %v", err)
+		}
+		if _, ok := metadata(rec.last(t), "db.query"); !ok {
+			t.Error("expected slow queries to always be kept")
+		}
+	}
+}
+
+func TestCaptureAffectedIDs(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithCaptureAffectedIDs(2))
+	migrateUsers(t, db, "alice", "bob", "carol")
+
+	if err := db.Delete(&testUser{}, []uint{1, 2, 3}).Error; err != nil {
+		t.Fatalf("failed to delete: %v", err)
+	}
+	seg := rec.last(t)
+	got, _ := metadata(seg, "db.affected_ids")
+	if ids, ok := got.([]string); !ok || len(ids) != 2 || ids[0] != "1" || ids[1] != "2" {
+		t.Errorf("expected db.affected_ids truncated to [1 2], got %v", got)
+	}
+	if total, _ := metadata(seg, "db.affected_ids.total"); total != 3 {
+		t.Errorf("expected db.affected_ids.total=3, got %v", total)
+	}
+
+	var users []testUser
+	if err := db.Where("id IN ?", []uint{1}).Find(&users).Error; err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+	if _, ok := metadata(rec.last(t), "db.affected_ids"); ok {
+		t.Error("expected db.affected_ids to be omitted for reads")
+	}
+}
+
+func TestCaptureAffectedIDsExpression(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithCaptureAffectedIDs(10))
+	migrateUsers(t, db, "alice", "bob", "carol")
+
+	if err := db.Where("id IN ?", []uint{2, 3}).Delete(&testUser{}).Error; err != nil {
+		t.Fatalf("failed to delete: %v", err)
+	}
+	got, _ := metadata(rec.last(t), "db.affected_ids")
+	if ids, ok := got.([]string); !ok || len(ids) != 2 || ids[0] != "2" || ids[1] != "3" {
+		t.Errorf("expected db.affected_ids [2 3], got %v", got)
+	}
+
+	if err := db.Model(&testUser{}).Where("id = ?", 1).Update("name", "dave").Error; err != nil {
+		t.Fatalf("failed to update: %v", err)
+	}
+	got, _ = metadata(rec.last(t), "db.affected_ids")
+	if ids, ok := got.([]string); !ok || len(ids) != 1 || ids[0] != "1" {
+		t.Errorf("expected db.affected_ids [1], got %v", got)
+	}
+}
+
+func TestCaptureAffectedIDsExcludeQueryVars(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithCaptureAffectedIDs(10), WithExcludeQueryVars(true))
+	migrateUsers(t, db, "alice", "bob")
+
+	if err := db.Delete(&testUser{}, []uint{1, 2}).Error; err != nil {
+		t.Fatalf("failed to delete: %v", err)
+	}
+	got, _ := metadata(rec.last(t), "db.affected_ids")
+	if ids, ok := got.([]string); !ok || len(ids) != 2 || ids[0] != "?" || ids[1] != "?" {
+		t.Errorf("expected masked db.affected_ids, got %v", got)
+	}
+}
+
+// statementRecordingPool records the statements executed on the wrapped connection pool.
+type statementRecordingPool struct {
+	gorm.ConnPool
+	mu      sync.Mutex
+	queries []string
+}
+
+func (p *statementRecordingPool) record(query string) {
+	p.mu.Lock()
+	p.queries = append(p.queries, query)
+	p.mu.Unlock()
+}
+
+func (p *statementRecordingPool) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	p.record(query)
+	return p.ConnPool.ExecContext(ctx, query, args...)
+}
+
+func (p *statementRecordingPool) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	p.record(query)
+	return p.ConnPool.QueryContext(ctx, query, args...)
+}
+
+func (p *statementRecordingPool) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	p.record(query)
+	return p.ConnPool.QueryRowContext(ctx, query, args...)
+}
+
+func TestTraceHeaderInjection(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithTraceHeaderInjection(TraceHeaderComment))
+	migrateUsers(t, db, "alice")
+	pool := &statementRecordingPool{ConnPool: db.Statement.ConnPool}
+	db.Statement.ConnPool = pool
+
+	var users []testUser
+	if err := db.Find(&users).Error; err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+	if len(users) != 1 {
+		t.Fatalf("expected 1 user, got %d", len(users))
+	}
+
+	seg := rec.last(t)
+	header := seg.DownstreamHeader().String()
+	if len(pool.queries) != 1 || !strings.HasPrefix(pool.queries[0], "/* X-Amzn-Trace-Id: "+header+" */ SELECT") {
+		t.Errorf("expected the executed statement to carry the trace header %q, got %v", header, pool.queries)
+	}
+	if got, _ := metadata(seg, "db.query"); strings.Contains(fmt.Sprint(got), "X-Amzn-Trace-Id") {
+		t.Errorf("expected the recorded query to omit the comment, got %v", got)
+	}
+	if db.Statement.ConnPool != pool {
+		t.Error("expected the connection pool to be restored after the query")
+	}
+}
+
+func TestTraceHeaderInjectionWithPreparedStatements(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithTraceHeaderInjection(TraceHeaderComment))
+	db = db.Session(&gorm.Session{PrepareStmt: true})
+	stmtDB, ok := db.Statement.ConnPool.(*gorm.PreparedStmtDB)
+	if !ok {
+		t.Fatalf("expected a prepared statement pool, got %T", db.Statement.ConnPool)
+	}
+
+	for i := 0; i < 5; i++ {
+		var result int
+		if err := db.Raw("SELECT 1").Scan(&result).Error; err != nil {
+			t.Fatalf("failed to execute query: %v", err)
+		}
+	}
+
+	stmtDB.Mux.RLock()
+	cached := len(stmtDB.Stmts)
+	stmtDB.Mux.RUnlock()
+	if cached != 1 {
+		t.Errorf("expected identical queries to share 1 prepared statement, got %d", cached)
+	}
+	if got, _ := metadata(rec.last(t), "db.trace_header.skipped"); got != "prepared statements" {
+		t.Errorf("expected db.trace_header.skipped to be recorded, got %v", got)
+	}
+}
+
+func TestTraceHeaderInjectionInTransaction(t *testing.T) {
+	db, _, _ := openTracedDB(t, WithTraceHeaderInjection(TraceHeaderComment))
+	migrateUsers(t, db, "alice", "bob")
+
+	var count int64
+	if err := db.Model(&testUser{}).Count(&count).Error; err != nil {
+		t.Fatalf("failed to count: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("expected writes inside GORM's default transaction to be committed, got %d users", count)
+	}
+}
+
+func TestSelfProfiling(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithSelfProfiling(true))
+
+	var result int
+	if err := db.Raw("SELECT 1").Scan(&result).Error; err != nil {
+		t.Fatalf("failed to execute query: %v", err)
+	}
+
+	got, ok := metadata(rec.last(t), "db.instrumentation_overhead_us")
+	if !ok {
+		t.Fatal("expected db.instrumentation_overhead_us to be recorded")
+	}
+	if us, ok := got.(int64); !ok || us < 0 {
+		t.Errorf("expected a non-negative overhead, got %v", got)
+	}
+}
+
+func TestFailFastOnFormatterError(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to connect database: %v", err)
+	}
+
+	panicking := func(string) string { panic("boom") }
+	err = db.Use(NewPlugin(WithQueryFormatter(panicking), WithFailFastOnFormatterError(true)))
+	if err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("expected registration to fail with the formatter panic, got %v", err)
+	}
+
+	err = db.Use(NewPlugin(WithQueryFormatter(strings.ToUpper), WithFailFastOnFormatterError(true)))
+	if err != nil {
+		t.Errorf("expected a working formatter to register, got %v", err)
+	}
+}
+
+// testAccount has a unique column, used to provoke constraint violations.
+type testAccount struct {
+	ID    uint
+	Email string `gorm:"uniqueIndex"`
+}
+
+func TestCaptureConstraintErrors(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithCaptureConstraintErrors(true))
+	if db.Dialector.Name() != "sqlite" {
+		t.Skip("constraint error format is engine specific")
+	}
+	if err := db.AutoMigrate(&testAccount{}); err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+	if err := db.Create(&testAccount{Email: "alice@example.com"}).Error; err != nil {
+		t.Fatalf("failed to create account: %v", err)
+	}
+
+	if err := db.Create(&testAccount{Email: "alice@example.com"}).Error; err == nil {
+		t.Fatal("expected a unique violation")
+	}
+	seg := rec.last(t)
+	if got, _ := metadata(seg, "db.constraint"); got != "test_accounts.email" {
+		t.Errorf("expected db.constraint=test_accounts.email, got %v", got)
+	}
+	seg.RLock()
+	defer seg.RUnlock()
+	if got := seg.Annotations["db.error_kind"]; got != "unique_violation" {
+		t.Errorf("expected db.error_kind=unique_violation, got %v", got)
+	}
+}
+
+// pgError mimics pgconn.PgError, which exposes the violated constraint as a field.
+type pgError struct {
+	Code           string
+	ConstraintName string
+}
+
+func (e *pgError) Error() string    { return "ERROR: duplicate key value (SQLSTATE " + e.Code + ")" }
+func (e *pgError) SQLState() string { return e.Code }
+
+func TestUniqueViolation(t *testing.T) {
+	tests := []struct {
+		err        error
+		constraint string
+		ok         bool
+	}{
+		{fmt.Errorf("create: %w", &pgError{Code: "23505", ConstraintName: "users_email_key"}), "users_email_key", true},
+		{errors.New("Error 1062 (23000): Duplicate entry 'alice' for key 'users.idx_email'"), "users.idx_email", true},
+		{gorm.ErrDuplicatedKey, "", true},
+		{&pgError{Code: "23503"}, "", false},
+	}
+	for _, tt := range tests {
+		constraint, ok := uniqueViolation(tt.err)
+		if constraint != tt.constraint || ok != tt.ok {
+			t.Errorf("uniqueViolation(%v) = %q, %v; want %q, %v", tt.err, constraint, ok, tt.constraint, tt.ok)
+		}
+	}
+}
+
+func TestSubsegmentPoolConcurrentQueries(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithSubsegmentPool(true))
+
+	const workers = 8
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx, root := xray.BeginSegment(context.Background(), fmt.Sprintf("worker-%d", i))
+			defer root.Close(nil)
+			for j := 0; j < 10; j++ {
+				var result int
+				if err := db.WithContext(ctx).Raw("SELECT ?", i).Scan(&result).Error; err != nil {
+					t.Errorf("failed to execute query: %v", err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	segs := rec.all()
+	if len(segs) != workers*10 {
+		t.Fatalf("expected %d subsegments, got %d", workers*10, len(segs))
+	}
+	for _, seg := range segs {
+		query, _ := metadata(seg, "db.query")
+		if want := "SELECT " + strings.TrimPrefix(seg.ParentSegment.Name, "worker-"); query != want {
+			t.Errorf("subsegment under %s recorded %v, want %q", seg.ParentSegment.Name, query, want)
+		}
+	}
+}
+
+func benchmarkQuery(b *testing.B, opts ...Option) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		b.Fatalf("failed to connect database: %v", err)
+	}
+	if err := db.Use(NewPlugin(opts...)); err != nil {
+		b.Fatalf("failed to register plugin: %v", err)
+	}
+	ctx, root := xray.BeginSegment(context.Background(), b.Name())
+	defer root.Close(nil)
+	db = db.WithContext(ctx)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var result int
+		if err := db.Raw("SELECT 1").Scan(&result).Error; err != nil {
+			b.Fatalf("failed to execute query: %v", err)
+		}
+	}
+}
+
+func BenchmarkQuery(b *testing.B) { benchmarkQuery(b) }
+
+func BenchmarkQuerySubsegmentPool(b *testing.B) { benchmarkQuery(b, WithSubsegmentPool(true)) }
+
+func TestSubsegmentPoolReleasesState(t *testing.T) {
+	p := NewPlugin(WithSubsegmentPool(true))
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to connect database: %v", err)
+	}
+	if err := db.Use(p); err != nil {
+		t.Fatalf("failed to register plugin: %v", err)
+	}
+	var held *statementState
+	capture := func(tx *gorm.DB) { held = p.statementStateOf(tx) }
+	if err := db.Callback().Raw().After("gorm:raw").Before(p.callbackName("after:raw")).Register("test:capture", capture); err != nil {
+		t.Fatalf("failed to register callback: %v", err)
+	}
+
+	ctx, root := xray.BeginSegment(context.Background(), t.Name())
+	defer root.Close(nil)
+	tx := db.WithContext(ctx).Exec("SELECT 1")
+	if tx.Error != nil {
+		t.Fatalf("failed to execute query: %v", tx.Error)
+	}
+
+	if held == nil || held.subsegment != nil {
+		t.Fatalf("expected the state to be reset once released, got %+v", held)
+	}
+	if st := p.statementStateOf(tx); st != nil {
+		t.Errorf("expected the released state to be detached from the statement, got %+v", st)
+	}
+}
+
+func TestSampledVars(t *testing.T) {
+	for _, tt := range []struct {
+		rate    float64
+		query   string
+		sampled bool
+	}{
+		{rate: 0, query: "SELECT ?", sampled: false},
+		{rate: 1, query: `SELECT "alice"`, sampled: true},
+	} {
+		db, _, rec := openTracedDB(t, WithSampledVars(tt.rate))
+		if err := db.Exec("SELECT ?", "alice").Error; err != nil {
+			t.Fatalf("failed to execute query: %v", err)
+		}
+
+		seg := rec.last(t)
+		if got, _ := metadata(seg, "db.query"); got != tt.query {
+			t.Errorf("rate %v: expected db.query=%q, got %v", tt.rate, tt.query, got)
+		}
+		if _, ok := metadata(seg, "db.vars.sampled"); ok != tt.sampled {
+			t.Errorf("rate %v: expected db.vars.sampled presence %v, got %v", tt.rate, tt.sampled, ok)
+		}
+	}
+}
+
+func TestCaptureGORMError(t *testing.T) {
+	errorLayerOf := func(seg *xray.Segment) interface{} {
+		seg.RLock()
+		defer seg.RUnlock()
+		return seg.Annotations["db.error_layer"]
+	}
+
+	db, _, rec := openTracedDB(t, WithCaptureGORMError(true))
+	if err := db.Exec("SELEC 1").Error; err == nil {
+		t.Fatal("expected a syntax error")
+	}
+	if got := errorLayerOf(rec.last(t)); got != "driver" {
+		t.Errorf("expected db.error_layer=driver for a syntax error, got %v", got)
+	}
+
+	ctx, cancel := context.WithCancel(db.Statement.Context)
+	cancel()
+	if err := db.WithContext(ctx).Exec("SELECT 1").Error; err == nil {
+		t.Fatal("expected a canceled context error")
+	}
+	if got := errorLayerOf(rec.last(t)); got != "context" {
+		t.Errorf("expected db.error_layer=context for a canceled query, got %v", got)
+	}
+
+	failQuery(t, db, fmt.Errorf("scan: %w", gorm.ErrInvalidData))
+	_ = db.Exec("SELECT 1").Error
+	if got := errorLayerOf(rec.last(t)); got != "gorm" {
+		t.Errorf("expected db.error_layer=gorm for gorm.ErrInvalidData, got %v", got)
+	}
+}
+
+func TestErrorLayer(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{gorm.ErrMissingWhereClause, "gorm"},
+		{fmt.Errorf("exec: %w", &stateError{code: "42601"}), "driver"},
+		{driver.ErrBadConn, "driver"},
+		{fmt.Errorf("query: %w", driver.ErrBadConn), "driver"},
+		{context.DeadlineExceeded, "context"},
+		{fmt.Errorf("query: %w", context.Canceled), "context"},
+		{errors.New("before create hook: name is required"), "unknown"},
+	}
+	for _, tt := range tests {
+		if got := errorLayer(tt.err); got != tt.want {
+			t.Errorf("errorLayer(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+// testBaggageKey stores test baggage members on a context.
+type testBaggageKey struct{}
+
+func readTestBaggage(ctx context.Context, key string) (string, bool) {
+	members, _ := ctx.Value(testBaggageKey{}).(map[string]string)
+	val, ok := members[key]
+	return val, ok
+}
+
+func TestBaggageAnnotations(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithBaggageAnnotations(readTestBaggage, "tenant", "missing"))
+
+	ctx := context.WithValue(db.Statement.Context, testBaggageKey{}, map[string]string{"tenant": "acme", "user": "42"})
+	var result int
+	if err := db.WithContext(ctx).Raw("SELECT 1").Scan(&result).Error; err != nil {
+		t.Fatalf("failed to execute query: %v", err)
+	}
+
+	seg := rec.last(t)
+	seg.RLock()
+	annotations := seg.Annotations
+	seg.RUnlock()
+	if annotations["tenant"] != "acme" {
+		t.Errorf("expected tenant=acme, got %v", annotations["tenant"])
+	}
+	if _, ok := annotations["missing"]; ok {
+		t.Error("expected missing baggage members to be skipped")
+	}
+	if _, ok := annotations["user"]; ok {
+		t.Error("expected unconfigured baggage members to be ignored")
+	}
+
+	// No baggage on the context at all
+	if err := db.Raw("SELECT 1").Scan(&result).Error; err != nil {
+		t.Fatalf("failed to execute query: %v", err)
+	}
+	seg = rec.last(t)
+	seg.RLock()
+	defer seg.RUnlock()
+	if len(seg.Annotations) != 0 {
+		t.Errorf("expected no annotations without baggage, got %v", seg.Annotations)
+	}
+}
+
+func TestRowsAffectedAnnotation(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithRowsAffectedAnnotation(true))
+	migrateUsers(t, db, "alice", "bob", "carol")
+
+	if err := db.Model(&testUser{}).Where("id > ?", 1).Update("name", "x").Error; err != nil {
+		t.Fatalf("failed to update: %v", err)
+	}
+	seg := rec.last(t)
+	seg.RLock()
+	got := seg.Annotations["db.rows_affected"]
+	seg.RUnlock()
+	if got != 2 {
+		t.Errorf("expected numeric db.rows_affected=2, got %v (%T)", got, got)
+	}
+
+	var users []testUser
+	if err := db.Find(&users).Error; err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+	seg = rec.last(t)
+	seg.RLock()
+	defer seg.RUnlock()
+	if _, ok := seg.Annotations["db.rows_affected"]; ok {
+		t.Error("expected db.rows_affected to be omitted for reads")
+	}
+}
+
+func TestCapturePlaceholderStyle(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithCapturePlaceholderStyle(true))
+
+	var result int
+	if err := db.Raw("SELECT ?", 1).Scan(&result).Error; err != nil {
+		t.Fatalf("failed to execute query: %v", err)
+	}
+	if got, _ := metadata(rec.last(t), "db.placeholder_style"); got != "question" {
+		t.Errorf("expected db.placeholder_style=question, got %v", got)
+	}
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"SELECT * FROM users WHERE id = $1 AND name = $2", "dollar"},
+		{"SELECT * FROM users WHERE id = ?", "question"},
+		{"SELECT * FROM users WHERE id = :id", "named"},
+		{"SELECT * FROM users WHERE id = @id", "named"},
+		{"SELECT created_at::date FROM users WHERE name = 'what?'", ""},
+	}
+	for _, tt := range tests {
+		if got := placeholderStyle(tt.query); got != tt.want {
+			t.Errorf("placeholderStyle(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestMaxConcurrentSubsegments(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to connect database: %v", err)
+	}
+	p := NewPlugin(WithMaxConcurrentSubsegments(3))
+	ctx, rootSegment := xray.BeginSegment(context.Background(), t.Name())
+	defer rootSegment.Close(nil)
+
+	// Simulate leaked subsegments by running the before hook without the after hook. Model returns a statement
+	// instance, like the ones callbacks receive.
+	var txs []*gorm.DB
+	for i := 0; i < 5; i++ {
+		tx := db.WithContext(ctx).Model(&testUser{})
+		p.before("gorm.Query")(tx)
+		txs = append(txs, tx)
+	}
+	stats := p.Stats()
+	if stats.OpenSubsegments != 3 || stats.Traced != 3 || stats.Dropped != 2 {
+		t.Fatalf("expected 3 open and 2 refused subsegments, got %+v", stats)
+	}
+	if _, ok := txs[4].InstanceGet(statementStateKey); ok {
+		t.Error("expected no subsegment to be started past the cap")
+	}
+
+	p.after()(txs[0])
+	if got := p.Stats().OpenSubsegments; got != 2 {
+		t.Errorf("expected closing a subsegment to free a slot, got %d open", got)
+	}
+	p.before("gorm.Query")(db.WithContext(ctx).Model(&testUser{}))
+	if stats := p.Stats(); stats.OpenSubsegments != 3 || stats.Traced != 4 {
+		t.Errorf("expected a new subsegment once below the cap, got %+v", stats)
+	}
+}
+
+func TestExplainSlowQueries(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithExplainSlowQueries(true), WithSlowKeepFastSample(50*time.Millisecond, 1))
+	if db.Dialector.Name() != "sqlite" {
+		t.Skip("plan format is engine specific")
+	}
+	migrateUsers(t, db, "alice")
+
+	var users []testUser
+	if err := db.Where("name = ?", "alice").Find(&users).Error; err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+	if _, ok := metadata(rec.last(t), "db.plan"); ok {
+		t.Error("expected fast queries not to be explained")
+	}
+
+	err := db.Callback().Query().After("xray:before:select").Before("gorm:query").Register("test:slow", func(tx *gorm.DB) {
+		time.Sleep(60 * time.Millisecond)
+	})
+	if err != nil {
+		t.Fatalf("failed to register slow callback: %v", err)
+	}
+	if err := db.Where("name = ?", "alice").Find(&users).Error; err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+
+	plan, ok := metadata(rec.last(t), "db.plan")
+	if !ok {
+		t.Fatal("expected a plan summary for the slow query")
+	}
+	nodes, _ := plan.(map[string]interface{})["nodes"].([]string)
+	if len(nodes) == 0 || !strings.Contains(nodes[0], "test_users") {
+		t.Errorf("expected the plan to scan test_users, got %v", plan)
+	}
+	for _, seg := range rec.all() {
+		if got, _ := metadata(seg, "db.query"); strings.HasPrefix(fmt.Sprint(got), "EXPLAIN") {
+			t.Error("expected the EXPLAIN itself not to be traced")
+		}
+	}
+}
+
+func TestTableAllowlist(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithTableAllowlist("test_orders"))
+	if err := db.AutoMigrate(&testUser{}, &testOrder{}); err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+
+	if err := db.Create(&testOrder{TestUserID: 1, Amount: 10}).Error; err != nil {
+		t.Fatalf("failed to create order: %v", err)
+	}
+	var users []testUser
+	if err := db.Find(&users).Error; err != nil {
+		t.Fatalf("failed to query users: %v", err)
+	}
+	var result int
+	if err := db.Raw("SELECT 1").Scan(&result).Error; err != nil {
+		t.Fatalf("failed to execute query: %v", err)
+	}
+
+	segs := rec.all()
+	if len(segs) != 1 {
+		t.Fatalf("expected only the orders query to be traced, got %d subsegments", len(segs))
+	}
+	if got, _ := metadata(segs[0], "db.table"); got != "test_orders" {
+		t.Errorf("expected the traced query to be on test_orders, got %v", got)
+	}
+
+	db, _, rec = openTracedDB(t, WithTableAllowlist("test_orders"), WithTraceUntabledRaw(true))
+	if err := db.Raw("SELECT 1").Scan(&result).Error; err != nil {
+		t.Fatalf("failed to execute query: %v", err)
+	}
+	if len(rec.all()) != 1 {
+		t.Error("expected raw queries without a table to be traced with WithTraceUntabledRaw")
+	}
+}
+
+func TestCaptureEngineVersion(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithCaptureEngineVersion(true))
+	if db.Dialector.Name() != "sqlite" {
+		t.Skip("version query is engine specific")
+	}
+
+	var version string
+	if err := db.Raw("SELECT sqlite_version()").Scan(&version).Error; err != nil {
+		t.Fatalf("failed to query version: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		var result int
+		if err := db.Raw("SELECT 1").Scan(&result).Error; err != nil {
+			t.Fatalf("failed to execute query: %v", err)
+		}
+		if got, _ := metadata(rec.last(t), "db.engine_version"); got != version {
+			t.Errorf("expected db.engine_version=%s, got %v", version, got)
+		}
+	}
+}
+
+func TestCaptureEngineVersionSharedAcrossTransactions(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to connect database: %v", err)
+	}
+	p := NewPlugin(WithCaptureEngineVersion(true))
+	if err := db.Use(p); err != nil {
+		t.Fatalf("failed to register plugin: %v", err)
+	}
+	ctx, root := xray.BeginSegment(context.Background(), t.Name())
+	defer root.Close(nil)
+	db = db.WithContext(ctx)
+
+	for i := 0; i < 5; i++ {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var result int
+			return tx.Raw("SELECT 1").Scan(&result).Error
+		})
+		if err != nil {
+			t.Fatalf("failed to run transaction: %v", err)
+		}
+	}
+
+	p.engineVersions.mu.Lock()
+	defer p.engineVersions.mu.Unlock()
+	if got := len(p.engineVersions.values); got != 1 {
+		t.Errorf("expected transactions on one database to share 1 version lookup, got %d", got)
+	}
+}
+
+func TestParseCommenterTags(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithParseCommenterTags(true))
+
+	var result int
+	query := "SELECT 1 /*action='show',controller='users',route='%2Fusers%2F%3Aid'*/ /* plain comment */"
+	if err := db.Raw(query).Scan(&result).Error; err != nil {
+		t.Fatalf("failed to execute query: %v", err)
+	}
+
+	seg := rec.last(t)
+	for key, want := range map[string]string{"controller": "users", "action": "show", "route": "/users/:id"} {
+		if got, _ := metadata(seg, "db.comment."+key); got != want {
+			t.Errorf("expected db.comment.%s=%q, got %v", key, want, got)
+		}
+	}
+	if _, ok := metadata(seg, "db.comment.plain"); ok {
+		t.Error("expected comments without key/value pairs to be ignored")
+	}
+}
+
+func TestCaptureSavepoints(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithCaptureSavepoints(true))
+	migrateUsers(t, db)
+
+	var outer, inner *xray.Segment
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&testUser{Name: "alice"}).Error; err != nil {
+			return err
+		}
+		outer = rec.last(t)
+		return tx.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(&testUser{Name: "bob"}).Error; err != nil {
+				return err
+			}
+			inner = rec.last(t)
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatalf("transaction failed: %v", err)
+	}
+
+	if _, ok := metadata(outer, "db.savepoint"); ok {
+		t.Error("expected top-level transaction statements not to carry db.savepoint")
+	}
+	if got, _ := metadata(inner, "db.savepoint"); got != true {
+		t.Errorf("expected nested transaction statements to carry db.savepoint=true, got %v", got)
+	}
+}
+
+func TestCaptureSavepointsAfterNestedTransaction(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to connect database: %v", err)
+	}
+	p := NewPlugin(WithCaptureSavepoints(true))
+	if err := db.Use(p); err != nil {
+		t.Fatalf("failed to register plugin: %v", err)
+	}
+	rec := recordSubsegments(t, db)
+	ctx, root := xray.BeginSegment(context.Background(), t.Name())
+	defer root.Close(nil)
+	db = db.WithContext(ctx)
+	migrateUsers(t, db)
+
+	var inner, after *xray.Segment
+	err = db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(&testUser{Name: "alice"}).Error; err != nil {
+				return err
+			}
+			inner = rec.last(t)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if err := tx.Create(&testUser{Name: "bob"}).Error; err != nil {
+			return err
+		}
+		after = rec.last(t)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("transaction failed: %v", err)
+	}
+
+	if got, _ := metadata(inner, "db.savepoint"); got != true {
+		t.Errorf("expected nested transaction statements to carry db.savepoint=true, got %v", got)
+	}
+	if _, ok := metadata(after, "db.savepoint"); ok {
+		t.Error("expected statements after a successful nested transaction not to carry db.savepoint")
+	}
+	p.savepoints.mu.Lock()
+	defer p.savepoints.mu.Unlock()
+	if got := len(p.savepoints.active); got != 0 {
+		t.Errorf("expected no savepoints to be tracked after the commit, got %d", got)
+	}
+}
+
+func TestCaptureSavepointsWithFilteredStatements(t *testing.T) {
+	for name, opt := range map[string]Option{
+		"min duration": WithMinDurationToRecord(10 * time.Millisecond),
+		"allowlist":    WithTableAllowlist("test_users"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+			if err != nil {
+				t.Fatalf("failed to connect database: %v", err)
+			}
+			p := NewPlugin(WithCaptureSavepoints(true), opt)
+			if err := db.Use(p); err != nil {
+				t.Fatalf("failed to register plugin: %v", err)
+			}
+			rec := recordSubsegments(t, db)
+			ctx, root := xray.BeginSegment(context.Background(), t.Name())
+			defer root.Close(nil)
+			db = db.WithContext(ctx)
+			migrateUsers(t, db, "alice")
+			err = db.Callback().Update().After(p.callbackName("before:update")).Before("gorm:update").
+				Register("test:slow", func(*gorm.DB) { time.Sleep(20 * time.Millisecond) })
+			if err != nil {
+				t.Fatalf("failed to register slow callback: %v", err)
+			}
+
+			var inner, after *xray.Segment
+			err = db.Transaction(func(tx *gorm.DB) error {
+				err := tx.Transaction(func(tx *gorm.DB) error {
+					if err := tx.Model(&testUser{}).Where("id = ?", 1).Update("name", "bob").Error; err != nil {
+						return err
+					}
+					inner = rec.last(t)
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+				if err := tx.Model(&testUser{}).Where("id = ?", 1).Update("name", "carol").Error; err != nil {
+					return err
+				}
+				after = rec.last(t)
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("transaction failed: %v", err)
+			}
+
+			if got, _ := metadata(inner, "db.savepoint"); got != true {
+				t.Errorf("expected the nested update to carry db.savepoint=true, got %v", got)
+			}
+			if _, ok := metadata(after, "db.savepoint"); ok {
+				t.Error("expected the update after the nested transaction not to carry db.savepoint")
+			}
+			p.savepoints.mu.Lock()
+			defer p.savepoints.mu.Unlock()
+			if got := len(p.savepoints.active); got != 0 {
+				t.Errorf("expected no savepoints to be tracked after the commit, got %d", got)
+			}
+		})
+	}
+}
+
+func TestRedactionAudit(t *testing.T) {
+	maskEmails := func(query string) string {
+		return regexp.MustCompile(`[\w.]+@[\w.]+`).ReplaceAllString(query, "<email>")
+	}
+	db, _, rec := openTracedDB(t, WithQueryFormatter(maskEmails), WithRedactionAudit(true))
+
+	if err := db.Exec("SELECT ?", "alice@example.com").Error; err != nil {
+		t.Fatalf("failed to execute query: %v", err)
+	}
+	seg := rec.last(t)
+	if got, _ := metadata(seg, "db.redacted"); got != true {
+		t.Errorf("expected db.redacted=true, got %v", got)
+	}
+	if got, _ := metadata(seg, "db.redaction.fields"); fmt.Sprint(got) != "[query]" {
+		t.Errorf("expected db.redaction.fields=[query], got %v", got)
+	}
+
+	if err := db.Exec("SELECT ?", "alice").Error; err != nil {
+		t.Fatalf("failed to execute query: %v", err)
+	}
+	if _, ok := metadata(rec.last(t), "db.redacted"); ok {
+		t.Error("expected no audit metadata when redaction left the query unchanged")
+	}
+
+	db, _, rec = openTracedDB(t, WithExcludeQueryVars(true), WithRedactionAudit(true))
+	if err := db.Exec("SELECT ?", "alice").Error; err != nil {
+		t.Fatalf("failed to execute query: %v", err)
+	}
+	if got, _ := metadata(rec.last(t), "db.redaction.fields"); fmt.Sprint(got) != "[vars]" {
+		t.Errorf("expected db.redaction.fields=[vars], got %v", got)
+	}
+}
+
+func TestCapturePipelineSize(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithCapturePipelineSize(true))
+	migrateUsers(t, db)
+
+	batch := "INSERT INTO test_users (name) VALUES ('a;b'); INSERT INTO test_users (name) VALUES ('c'); " +
+		"UPDATE test_users SET name = 'd' WHERE name = 'c'; -- trailing; comment"
+	if err := db.Exec(batch).Error; err != nil {
+		t.Fatalf("failed to execute batch: %v", err)
+	}
+	if got, _ := metadata(rec.last(t), "db.pipeline.size"); got != 3 {
+		t.Errorf("expected db.pipeline.size=3, got %v", got)
+	}
+
+	if err := db.Exec("DELETE FROM test_users;").Error; err != nil {
+		t.Fatalf("failed to execute query: %v", err)
+	}
+	if _, ok := metadata(rec.last(t), "db.pipeline.size"); ok {
+		t.Error("expected db.pipeline.size to be omitted for a single statement")
+	}
+}
+
+// retryableError is an application error that should not mark subsegments as faulty.
+type retryableError struct{ err error }
+
+func (e *retryableError) Error() string { return "retryable: " + e.err.Error() }
+func (e *retryableError) Unwrap() error { return e.err }
+
+func TestAdditionalNonCritical(t *testing.T) {
+	isRetryable := func(err error) bool {
+		var retryable *retryableError
+		return errors.As(err, &retryable)
+	}
+	db, _, rec := openTracedDB(t, WithAdditionalNonCritical(isRetryable))
+
+	failQuery(t, db, fmt.Errorf("exec: %w", &retryableError{err: errors.New("lock timeout")}))
+	if err := db.Exec("SELECT 1").Error; err == nil {
+		t.Fatal("expected the query to fail")
+	}
+	if seg := rec.last(t); seg.Fault || seg.Error {
+		t.Error("expected an error matching the predicate to be non-critical")
+	}
+
+	p := NewPlugin(WithAdditionalNonCritical(isRetryable))
+	if !p.isNonCriticalError(sql.ErrNoRows) {
+		t.Error("expected the default non-critical errors to still apply")
+	}
+	if p.isNonCriticalError(errors.New("boom")) {
+		t.Error("expected other errors to stay critical")
+	}
+}
+
+func TestCaptureSchema(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithCaptureSchema(true))
+
+	var result int
+	if err := db.Raw("SELECT 1").Scan(&result).Error; err != nil {
+		t.Fatalf("failed to execute query: %v", err)
+	}
+	if _, ok := metadata(rec.last(t), "db.schema"); ok {
+		t.Error("expected db.schema to be omitted when no schema is configured")
+	}
+
+	ctx := ContextWithSchema(db.Statement.Context, "tenant_42")
+	if err := db.WithContext(ctx).Raw("SELECT 1").Scan(&result).Error; err != nil {
+		t.Fatalf("failed to execute query: %v", err)
+	}
+	if got, _ := metadata(rec.last(t), "db.schema"); got != "tenant_42" {
+		t.Errorf("expected db.schema=tenant_42, got %v", got)
+	}
+}
+
+func TestSchemaFromDSN(t *testing.T) {
+	tests := []struct {
+		dsn  string
+		want string
+	}{
+		{"host=localhost user=app search_path=tenant_1 sslmode=disable", "tenant_1"},
+		{"host=localhost search_path='tenant_2,public'", "tenant_2,public"},
+		{"postgres://app@localhost:5432/app?search_path=tenant_3", "tenant_3"},
+		{"file::memory:", ""},
+	}
+	for _, tt := range tests {
+		if got := schemaFromDSN(tt.dsn); got != tt.want {
+			t.Errorf("schemaFromDSN(%q) = %q, want %q", tt.dsn, got, tt.want)
+		}
+	}
+}
+
+func TestSkipReasons(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to connect database: %v", err)
+	}
+	p := NewPlugin(WithSkipReasons(true), WithTableAllowlist("test_orders"))
+	if err := db.Use(p); err != nil {
+		t.Fatalf("failed to register plugin: %v", err)
+	}
+
+	var users []testUser
+	if err := db.AutoMigrate(&testUser{}); err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+	if err := db.Find(&users).Error; err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+	p.SetEnabled(false)
+	for i := 0; i < 2; i++ {
+		if err := db.Find(&users).Error; err != nil {
+			t.Fatalf("failed to query: %v", err)
+		}
+	}
+
+	reasons := p.Stats().SkipReasons
+	if reasons[SkipReasonDisabled] != 2 {
+		t.Errorf("expected 2 queries skipped as disabled, got %d", reasons[SkipReasonDisabled])
+	}
+	if reasons[SkipReasonFilteredTable] == 0 {
+		t.Error("expected queries on other tables to be counted as filtered_table")
+	}
+	if reasons[SkipReasonRateLimited] != 0 {
+		t.Errorf("expected no rate-limited queries, got %d", reasons[SkipReasonRateLimited])
+	}
+
+	if NewPlugin().Stats().SkipReasons != nil {
+		t.Error("expected no skip reasons unless enabled")
+	}
+}
+
+func TestMetadataMarshaler(t *testing.T) {
+	at := time.Date(2024, 3, 1, 12, 30, 0, 0, time.FixedZone("CET", 3600))
+	db, _, rec := openTracedDB(t,
+		WithFinalMetadataFunc(func(tx *gorm.DB, dur time.Duration, err error) map[string]interface{} {
+			return map[string]interface{}{"app.requested_at": at, "app.tenant": "acme"}
+		}),
+		WithMetadataMarshaler(func(v interface{}) interface{} {
+			if ts, ok := v.(time.Time); ok {
+				return ts.UTC().Format(time.RFC3339)
+			}
+			return v
+		}),
+	)
+
+	var result int
+	if err := db.Raw("SELECT 1").Scan(&result).Error; err != nil {
+		t.Fatalf("failed to execute query: %v", err)
+	}
+
+	seg := rec.last(t)
+	if got, _ := metadata(seg, "app.requested_at"); got != "2024-03-01T11:30:00Z" {
+		t.Errorf("expected app.requested_at to be reformatted, got %v", got)
+	}
+	if got, _ := metadata(seg, "app.tenant"); got != "acme" {
+		t.Errorf("expected scalar metadata to be added as-is, got %v", got)
+	}
+}
+
+func TestCaptureCallerChain(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithCaptureCallerChain(3))
+
+	var result int
+	if err := db.Raw("SELECT 1").Scan(&result).Error; err != nil {
+		t.Fatalf("failed to execute query: %v", err)
+	}
+
+	got, ok := metadata(rec.last(t), "db.caller.chain")
+	if !ok {
+		t.Fatal("expected db.caller.chain metadata")
+	}
+	chain, ok := got.([]string)
+	if !ok || len(chain) == 0 || len(chain) > 3 {
+		t.Fatalf("expected at most 3 caller frames, got %v", got)
+	}
+	if !strings.Contains(chain[0], "plugin_test.go:") || !strings.HasSuffix(chain[0], ":gormxray.TestCaptureCallerChain") {
+		t.Errorf("expected the chain to start at the test function, got %v", chain)
+	}
+	for _, entry := range chain {
+		if strings.Contains(entry, "testing.tRunner") || strings.Contains(entry, "gorm.io/") {
+			t.Errorf("expected gorm and stdlib frames to be skipped, got %q", entry)
+		}
+	}
+}
+
+func TestExplainFullScan(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithExplainSlowQueries(true), WithSlowKeepFastSample(time.Nanosecond, 1))
+	if db.Dialector.Name() != "sqlite" {
+		t.Skip("full scan detection is SQLite specific")
+	}
+	migrateUsers(t, db, "alice")
+	err := db.Callback().Query().After("xray:before:select").Before("gorm:query").Register("test:slow", func(tx *gorm.DB) {
+		time.Sleep(time.Millisecond)
+	})
+	if err != nil {
+		t.Fatalf("failed to register slow callback: %v", err)
+	}
+
+	var users []testUser
+	if err := db.Where("name = ?", "alice").Find(&users).Error; err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+	if got := rec.last(t).Annotations["db.full_scan"]; got != true {
+		t.Errorf("expected db.full_scan=true without an index, got %v", got)
+	}
+
+	if err := db.Exec("CREATE INDEX idx_test_users_name ON test_users (name)").Error; err != nil {
+		t.Fatalf("failed to create index: %v", err)
+	}
+	if err := db.Where("name = ?", "alice").Find(&users).Error; err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+	seg := rec.last(t)
+	if _, ok := seg.Annotations["db.full_scan"]; ok {
+		t.Errorf("expected no db.full_scan annotation with an index, got plan %v", seg.Metadata["default"]["db.plan"])
+	}
+}
+
+func TestTransactionOutcomeHooks(t *testing.T) {
+	var committed, rolledBack int
+	var rollbackErr error
+	db, _, rec := openTracedDB(t,
+		WithAfterCommit(func(ctx context.Context, tx *gorm.DB) {
+			committed++
+		}),
+		WithAfterRollback(func(ctx context.Context, tx *gorm.DB, err error) {
+			rolledBack++
+			rollbackErr = err
+		}),
+	)
+	if err := db.AutoMigrate(&testUser{}); err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+
+	if err := db.Create(&testUser{ID: 1, Name: "alice"}).Error; err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	if committed != 1 || rolledBack != 0 {
+		t.Errorf("expected only the commit hook to fire, got %d commits and %d rollbacks", committed, rolledBack)
+	}
+	if got, _ := metadata(rec.last(t), "db.tx.outcome"); got != "commit" {
+		t.Errorf("expected db.tx.outcome=commit, got %v", got)
+	}
+
+	err := db.Create(&testUser{ID: 1, Name: "bob"}).Error
+	if err == nil {
+		t.Fatal("expected a primary key violation")
+	}
+	if committed != 1 || rolledBack != 1 {
+		t.Errorf("expected the rollback hook to fire, got %d commits and %d rollbacks", committed, rolledBack)
+	}
+	if rollbackErr != err {
+		t.Errorf("expected the rollback hook to receive %v, got %v", err, rollbackErr)
+	}
+	if got, _ := metadata(rec.last(t), "db.tx.outcome"); got != "rollback" {
+		t.Errorf("expected db.tx.outcome=rollback, got %v", got)
+	}
+
+	var users []testUser
+	if err := db.Find(&users).Error; err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+	if _, ok := metadata(rec.last(t), "db.tx.outcome"); ok {
+		t.Error("expected queries outside a transaction to have no db.tx.outcome")
+	}
+}
+
+func TestCaptureDestType(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithCaptureDestType(true))
+	migrateUsers(t, db, "alice")
+
+	var users []testUser
+	if err := db.Find(&users).Error; err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+	if got, _ := metadata(rec.last(t), "db.dest_type"); got != "[]gormxray.testUser" {
+		t.Errorf("expected db.dest_type=[]gormxray.testUser, got %v", got)
+	}
+
+	if err := db.Exec("DELETE FROM test_users").Error; err != nil {
+		t.Fatalf("failed to execute: %v", err)
+	}
+	if _, ok := metadata(rec.last(t), "db.dest_type"); ok {
+		t.Error("expected db.dest_type to be omitted without a destination")
+	}
+}
+
+func TestDestTypeName(t *testing.T) {
+	user := &testUser{}
+	tests := []struct {
+		dest interface{}
+		want string
+	}{
+		{nil, ""},
+		{&[]testUser{}, "[]gormxray.testUser"},
+		{&user, "gormxray.testUser"},
+		{&[]*testUser{}, "[]*gormxray.testUser"},
+		{map[string]interface{}{}, "map[string]interface {}"},
+	}
+	for _, tt := range tests {
+		if got := destTypeName(tt.dest); got != tt.want {
+			t.Errorf("destTypeName(%T) = %q, want %q", tt.dest, got, tt.want)
+		}
+	}
+}
+
+func TestSuppressDuplicateErrors(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithSuppressDuplicateErrors(true))
+	failQuery(t, db, errors.New("connection reset"))
+
+	for i := 0; i < 3; i++ {
+		if err := db.Exec("SELECT 1").Error; err == nil {
+			t.Fatal("expected the query to fail")
+		}
+	}
+
+	segs := rec.all()
+	if len(segs) != 3 {
+		t.Fatalf("expected 3 subsegments, got %d", len(segs))
+	}
+	faults := 0
+	for _, seg := range segs {
+		if seg.Fault {
+			faults++
+		}
+	}
+	if faults != 1 || !segs[0].Fault {
+		t.Errorf("expected only the first error to be recorded as a fault, got %d faults", faults)
+	}
+	if got, _ := metadata(segs[2], "db.error.suppressed_count"); got != 2 {
+		t.Errorf("expected db.error.suppressed_count=2 on the third error, got %v", got)
+	}
+	if got, _ := metadata(segs[2], "db.error"); got != true {
+		t.Errorf("expected suppressed errors to be recorded as db.error metadata, got %v", got)
+	}
+}
+
+// testNote has a gorm.DeletedAt field, so GORM soft deletes it.
+type testNote struct {
+	ID        uint
+	Body      string
+	DeletedAt gorm.DeletedAt
+}
+
+func TestSoftDelete(t *testing.T) {
+	db, _, rec := openTracedDB(t)
+	if err := db.AutoMigrate(&testNote{}); err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+	note := testNote{Body: "draft"}
+	if err := db.Create(&note).Error; err != nil {
+		t.Fatalf("failed to create note: %v", err)
+	}
+	if _, ok := metadata(rec.last(t), "db.soft_delete"); ok {
+		t.Error("expected creates not to be marked as soft deletes")
+	}
+
+	if err := db.Delete(&note).Error; err != nil {
+		t.Fatalf("failed to delete note: %v", err)
+	}
+	seg := rec.last(t)
+	if got, _ := metadata(seg, "db.soft_delete"); got != true {
+		t.Errorf("expected db.soft_delete=true, got %v", got)
+	}
+	if got, _ := metadata(seg, "db.operation"); got != "update" {
+		t.Errorf("expected the soft delete to run as an update, got %v", got)
+	}
+
+	if err := db.Unscoped().Delete(&note).Error; err != nil {
+		t.Fatalf("failed to delete note: %v", err)
+	}
+	if _, ok := metadata(rec.last(t), "db.soft_delete"); ok {
+		t.Error("expected unscoped deletes not to be marked as soft deletes")
+	}
+}
+
+func TestFlushOnClose(t *testing.T) {
+	NewPlugin().Flush()
+	NewPlugin(WithFlushOnClose(true)).Flush()
+
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to connect database: %v", err)
+	}
+	p := NewPlugin(WithFlushOnClose(true))
+	if err := db.Use(p); err != nil {
+		t.Fatalf("failed to register plugin: %v", err)
+	}
+	rec := recordSubsegments(t, db)
+
+	var result int
+	if err := db.Raw("SELECT 1").Scan(&result).Error; err != nil {
+		t.Fatalf("failed to execute query: %v", err)
+	}
+	fallback := rec.last(t).ParentSegment
+	fallback.RLock()
+	inProgress := fallback.InProgress
+	fallback.RUnlock()
+	if fallback.Name != "FallbackParent" || inProgress {
+		t.Errorf("expected the fallback segment %q to be closed with its query", fallback.Name)
+	}
+	p.Flush()
+}
+
+// testProfile belongs to a testUser and is used as a second association to preload.
+type testProfile struct {
+	ID         uint
+	TestUserID uint
+	Bio        string
+}
+
+// testMember is a testUser with its orders and profile.
+type testMember struct {
+	ID      uint
+	Name    string
+	Orders  []testOrder `gorm:"foreignKey:TestUserID"`
+	Profile testProfile `gorm:"foreignKey:TestUserID"`
+}
+
+func (testMember) TableName() string {
+	return "test_users"
+}
+
+func TestCapturePreloadInfo(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithCapturePreloadInfo(true))
+	migrateUsers(t, db, "alice")
+	if err := db.AutoMigrate(&testOrder{}, &testProfile{}); err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+
+	var members []testMember
+	if err := db.Preload("Profile").Preload("Orders").Find(&members).Error; err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+
+	// The preloading query completes after the queries it preloads
+	seg := rec.last(t)
+	if got, _ := metadata(seg, "db.preload.count"); got != 2 {
+		t.Errorf("expected db.preload.count=2, got %v", got)
+	}
+	names, _ := metadata(seg, "db.preload.names")
+	if got, ok := names.([]string); !ok || len(got) != 2 || got[0] != "Orders" || got[1] != "Profile" {
+		t.Errorf("expected db.preload.names=[Orders Profile], got %v", names)
+	}
+
+	if err := db.Find(&members).Error; err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+	if _, ok := metadata(rec.last(t), "db.preload.count"); ok {
+		t.Error("expected db.preload.count to be omitted without preloads")
+	}
+}
+
+func TestErrorAnnotationSampling(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithErrorAnnotationSampling(2))
+	var queryErr error
+	err := db.Callback().Raw().After("gorm:raw").Before("xray:after:raw").Register("test:fail", func(tx *gorm.DB) {
+		tx.AddError(queryErr)
+	})
+	if err != nil {
+		t.Fatalf("failed to register failing callback: %v", err)
+	}
+
+	for _, msg := range []string{"timeout on shard 1", "timeout on shard 2", "timeout on shard 1", "timeout on shard 3"} {
+		queryErr = errors.New(msg)
+		if err := db.Exec("SELECT 1").Error; err == nil {
+			t.Fatal("expected the query to fail")
+		}
+	}
+
+	segs := rec.all()
+	if len(segs) != 4 {
+		t.Fatalf("expected 4 subsegments, got %d", len(segs))
+	}
+	for i, want := range []string{"timeout on shard 1", "timeout on shard 2", "timeout on shard 1"} {
+		if got := segs[i].Annotations["db.error_type"]; got != want {
+			t.Errorf("expected db.error_type=%q annotation on query %d, got %v", want, i, got)
+		}
+	}
+	overflow := segs[3]
+	if _, ok := overflow.Annotations["db.error_type"]; ok {
+		t.Error("expected errors over the distinct cap not to be annotated")
+	}
+	if got, _ := metadata(overflow, "db.error_type"); got != "timeout on shard 3" {
+		t.Errorf("expected the overflow error in db.error_type metadata, got %v", got)
+	}
+}
+
+func TestCaptureUpdateColumns(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithCaptureUpdateColumns(true))
+	if err := db.AutoMigrate(&testOrder{}); err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+	order := testOrder{TestUserID: 1, Amount: 10}
+	if err := db.Create(&order).Error; err != nil {
+		t.Fatalf("failed to create order: %v", err)
+	}
+
+	err := db.Model(&order).Updates(map[string]interface{}{"test_user_id": 4242, "amount": 9999}).Error
+	if err != nil {
+		t.Fatalf("failed to update order: %v", err)
+	}
+
+	val, ok := metadata(rec.last(t), "db.update.columns")
+	if !ok {
+		t.Fatal("expected db.update.columns metadata")
+	}
+	columns, _ := val.([]string)
+	if len(columns) != 2 || columns[0] != "amount" || columns[1] != "test_user_id" {
+		t.Errorf("expected db.update.columns=[amount test_user_id], got %v", val)
+	}
+	if s := fmt.Sprint(val); strings.Contains(s, "4242") || strings.Contains(s, "9999") {
+		t.Errorf("expected update values to be masked, got %v", s)
+	}
+}
+
+type testEndpointKey struct{}
+
+func TestGroupingKeyFromContext(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithGroupingKeyFromContext(testEndpointKey{}, "endpoint"))
+
+	ctx := context.WithValue(db.Statement.Context, testEndpointKey{}, "GET /orders")
+	var result int
+	for i := 0; i < 2; i++ {
+		if err := db.WithContext(ctx).Raw("SELECT 1").Scan(&result).Error; err != nil {
+			t.Fatalf("failed to execute query: %v", err)
+		}
+	}
+	if err := db.Raw("SELECT 1").Scan(&result).Error; err != nil {
+		t.Fatalf("failed to execute query: %v", err)
+	}
+
+	segs := rec.all()
+	if len(segs) != 3 {
+		t.Fatalf("expected 3 subsegments, got %d", len(segs))
+	}
+	for _, seg := range segs[:2] {
+		if got := seg.Annotations["endpoint"]; got != "GET /orders" {
+			t.Errorf("expected endpoint=GET /orders, got %v", got)
+		}
+	}
+	if _, ok := segs[2].Annotations["endpoint"]; ok {
+		t.Error("expected no endpoint annotation without a grouping key in the context")
+	}
+}
+
+func TestCaptureResultSize(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithCaptureResultSize(true))
+	migrateUsers(t, db, "alice", "bob")
+
+	var users []testUser
+	if err := db.Find(&users).Error; err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+	got, ok := metadata(rec.last(t), "db.result.bytes_estimate")
+	size, _ := got.(int64)
+	if !ok || size < int64(len("alice")+len("bob")) {
+		t.Errorf("expected a bytes estimate covering both rows, got %v", got)
+	}
+
+	var result int
+	if err := db.Raw("SELECT 1").Scan(&result).Error; err != nil {
+		t.Fatalf("failed to execute query: %v", err)
+	}
+	if _, ok := metadata(rec.last(t), "db.result.bytes_estimate"); ok {
+		t.Error("expected no estimate for a destination that isn't a model")
+	}
+}
+
+// metricsRecorder is a MetricsSink that records the labels it receives.
+type metricsRecorder struct {
+	mu     sync.Mutex
+	labels []string
+}
+
+func (m *metricsRecorder) ObserveQuery(op, table string, dur time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.labels = append(m.labels, op+" "+table)
+}
+
+func TestOperationMetricLabels(t *testing.T) {
+	sink := &metricsRecorder{}
+	tenantTable := regexp.MustCompile(`^tenant_\d+_`)
+	db, _, _ := openTracedDB(t,
+		WithMetricsSink(sink),
+		WithOperationMetricLabels(func(op, table string) (string, string) {
+			return op, tenantTable.ReplaceAllString(table, "tenant_*_")
+		}),
+	)
+	for _, table := range []string{"tenant_1_orders", "tenant_2_orders"} {
+		if err := db.Exec("CREATE TABLE " + table + " (id integer)").Error; err != nil {
+			t.Fatalf("failed to create table: %v", err)
+		}
+		var count int64
+		if err := db.Table(table).Count(&count).Error; err != nil {
+			t.Fatalf("failed to count: %v", err)
+		}
+	}
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	want := []string{"create ", "select tenant_*_orders", "create ", "select tenant_*_orders"}
+	if len(sink.labels) != len(want) {
+		t.Fatalf("expected labels %v, got %v", want, sink.labels)
+	}
+	for i := range want {
+		if sink.labels[i] != want[i] {
+			t.Errorf("expected label %q, got %q", want[i], sink.labels[i])
+		}
+	}
+}
+
+func TestDetectNewConnection(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithDetectNewConnection(true))
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatalf("failed to get sql.DB: %v", err)
+	}
+
+	// Without idle connections, every query opens a new one
+	sqlDB.SetMaxIdleConns(0)
+	var result int
+	if err := db.Raw("SELECT 1").Scan(&result).Error; err != nil {
+		t.Fatalf("failed to execute query: %v", err)
+	}
+	if got, _ := metadata(rec.last(t), "db.new_connection"); got != true {
+		t.Errorf("expected db.new_connection=true, got %v", got)
+	}
+
+	sqlDB.SetMaxIdleConns(1)
+	for _, want := range []bool{true, false} {
+		if err := db.Exec("SELECT 1").Error; err != nil {
+			t.Fatalf("failed to execute query: %v", err)
+		}
+		if got, _ := metadata(rec.last(t), "db.new_connection"); got != want {
+			t.Errorf("expected db.new_connection=%v, got %v", want, got)
+		}
+	}
+}
+
+type testRequestIDKey struct{}
+
+type testUserIDKey struct{}
+
+func TestContextValuesToMetadata(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithContextValuesToMetadata(map[interface{}]string{
+		testRequestIDKey{}: "request.id",
+		testUserIDKey{}:    "user.id",
+		testEndpointKey{}:  "endpoint",
+	}))
+
+	ctx := context.WithValue(db.Statement.Context, testRequestIDKey{}, "req-123")
+	ctx = context.WithValue(ctx, testUserIDKey{}, 42)
+	var result int
+	if err := db.WithContext(ctx).Raw("SELECT 1").Scan(&result).Error; err != nil {
+		t.Fatalf("failed to execute query: %v", err)
+	}
+
+	seg := rec.last(t)
+	if got, _ := metadata(seg, "request.id"); got != "req-123" {
+		t.Errorf("expected request.id=req-123, got %v", got)
+	}
+	if got, _ := metadata(seg, "user.id"); got != "42" {
+		t.Errorf("expected user.id to be stringified, got %v", got)
+	}
+	if _, ok := metadata(seg, "endpoint"); ok {
+		t.Error("expected context values that aren't set to be skipped")
+	}
+}
+
+func TestCaptureNamingStrategy(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithCaptureNamingStrategy(true))
+	migrateUsers(t, db, "alice")
+
+	var users []testUser
+	for i := 0; i < 2; i++ {
+		if err := db.Find(&users).Error; err != nil {
+			t.Fatalf("failed to query: %v", err)
+		}
+	}
+
+	var strategies []interface{}
+	for _, seg := range rec.all() {
+		if val, ok := metadata(seg, "db.naming_strategy"); ok {
+			strategies = append(strategies, val)
+		}
+	}
+	if len(strategies) != 1 || strategies[0] != "schema.NamingStrategy" {
+		t.Errorf("expected db.naming_strategy=schema.NamingStrategy exactly once, got %v", strategies)
+	}
+}
+
+func TestMaxAnnotationValueLength(t *testing.T) {
+	db, _, rec := openTracedDB(t,
+		WithMaxAnnotationValueLength(20),
+		WithGroupingKeyFromContext(testEndpointKey{}, "endpoint"),
+	)
+
+	long := "GET /tenants/{tenant}/orders/{order}/items"
+	ctx := context.WithValue(db.Statement.Context, testEndpointKey{}, long)
+	var result int
+	if err := db.WithContext(ctx).Raw("SELECT 1").Scan(&result).Error; err != nil {
+		t.Fatalf("failed to execute query: %v", err)
+	}
+
+	got, _ := rec.last(t).Annotations["endpoint"].(string)
+	if want := long[:17] + "..."; got != want {
+		t.Errorf("expected endpoint to be truncated to %q, got %q", want, got)
+	}
+	if len(got) != 20 {
+		t.Errorf("expected 20 characters, got %d", len(got))
+	}
+
+	if got := truncateValue("short", 20); got != "short" {
+		t.Errorf("expected short values to be kept, got %q", got)
+	}
+}
+
+func TestCaptureCount(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithCaptureCount(true))
+	migrateUsers(t, db, "alice", "bob")
+
+	var count int64
+	if err := db.Model(&testUser{}).Count(&count).Error; err != nil {
+		t.Fatalf("failed to count: %v", err)
+	}
+	if got := rec.last(t).Annotations["db.method"]; got != "count" {
+		t.Errorf("expected db.method=count, got %v", got)
+	}
+
+	var users []testUser
+	if err := db.Find(&users).Error; err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+	if _, ok := rec.last(t).Annotations["db.method"]; ok {
+		t.Error("expected row-fetching selects not to be marked as counts")
+	}
+}
+
+type testJobIDKey struct{}
+
+func TestFallbackSegmentNameFromContext(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to connect database: %v", err)
+	}
+	err = db.Use(NewPlugin(WithFallbackSegmentNameFromContext(func(ctx context.Context) string {
+		if id, ok := ctx.Value(testJobIDKey{}).(string); ok {
+			return "job-" + id
+		}
+		return ""
+	})))
+	if err != nil {
+		t.Fatalf("failed to register plugin: %v", err)
+	}
+	rec := recordSubsegments(t, db)
+
+	var result int
+	ctx := context.WithValue(context.Background(), testJobIDKey{}, "nightly-42")
+	if err := db.WithContext(ctx).Raw("SELECT 1").Scan(&result).Error; err != nil {
+		t.Fatalf("failed to execute query: %v", err)
+	}
+	if got := rec.last(t).ParentSegment.Name; got != "job-nightly-42" {
+		t.Errorf("expected the fallback segment to be named job-nightly-42, got %q", got)
+	}
+
+	if err := db.Raw("SELECT 1").Scan(&result).Error; err != nil {
+		t.Fatalf("failed to execute query: %v", err)
+	}
+	if got := rec.last(t).ParentSegment.Name; got != "FallbackParent" {
+		t.Errorf("expected the static name without a job id, got %q", got)
+	}
+}
+
+func TestClassifyTermination(t *testing.T) {
+	db, _, rec := openTracedDB(t, WithClassifyTermination(true))
+
+	expired, cancelExpired := context.WithDeadline(db.Statement.Context, time.Now().Add(-time.Second))
+	defer cancelExpired()
+	canceled, cancel := context.WithCancel(db.Statement.Context)
+	cancel()
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want string
+	}{
+		{"completed", db.Statement.Context, "completed"},
+		{"timeout", expired, "timeout"},
+		{"canceled", canceled, "canceled"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_ = db.WithContext(tt.ctx).Exec("SELECT 1").Error
+			if got := rec.last(t).Annotations["db.termination"]; got != tt.want {
+				t.Errorf("expected db.termination=%s, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestInstanceKeyNamespace(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to connect database: %v", err)
+	}
+	outer, inner := NewPlugin(WithInstanceKeyNamespace("a")), NewPlugin(WithInstanceKeyNamespace("b"))
+	for _, p := range []*Plugin{outer, inner} {
+		if err := db.Use(p); err != nil {
+			t.Fatalf("failed to register plugin %s: %v", p.Name(), err)
+		}
+	}
+
+	var outerSeg, innerSeg *xray.Segment
+	err = db.Callback().Raw().After("b:xray:before:raw").Before("gorm:raw").Register("test:capture", func(tx *gorm.DB) {
+		outerSeg, _ = tx.Statement.Context.Value(subsegmentKey{"a"}).(*xray.Segment)
+		innerSeg, _ = tx.Statement.Context.Value(subsegmentKey{"b"}).(*xray.Segment)
+	})
+	if err != nil {
+		t.Fatalf("failed to register capture callback: %v", err)
+	}
+
+	ctx, root := xray.BeginSegment(context.Background(), t.Name())
+	defer root.Close(nil)
+	if err := db.WithContext(ctx).Exec("SELECT 1").Error; err != nil {
+		t.Fatalf("failed to execute query: %v", err)
+	}
+
+	if outerSeg == nil || innerSeg == nil || outerSeg == innerSeg {
+		t.Fatalf("expected each plugin to start its own subsegment, got %v and %v", outerSeg, innerSeg)
+	}
+	for _, seg := range []*xray.Segment{outerSeg, innerSeg} {
+		seg.RLock()
+		inProgress := seg.InProgress
+		seg.RUnlock()
+		if inProgress {
+			t.Errorf("expected subsegment %s to be closed by its own plugin", seg.Name)
+		}
+		if _, ok := metadata(seg, "db.query"); !ok {
+			t.Errorf("expected subsegment %s to have its metadata", seg.Name)
+		}
+	}
+	if outer.Stats().Traced != 1 || inner.Stats().Traced != 1 {
+		t.Errorf("expected each plugin to trace the query once, got %d and %d", outer.Stats().Traced, inner.Stats().Traced)
+	}
+}
+
+func TestQueryEventCallback(t *testing.T) {
+	var events []QueryEvent
+	db, _, _ := openTracedDB(t,
+		WithQueryEventCallback(func(event QueryEvent) {
+			events = append(events, event)
+		}),
+		WithClassifyTermination(true),
+	)
+	migrateUsers(t, db, "alice", "bob")
+
+	events = nil
+	var users []testUser
+	if err := db.Find(&users).Error; err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("expected one event, got %d", len(events))
+	}
+	event := events[0]
+	if event.Operation != "select" || event.Table != "test_users" || !strings.Contains(event.Query, "test_users") {
+		t.Errorf("unexpected select event %+v", event)
+	}
+	if event.Duration <= 0 || event.RowsAffected != 2 || event.Err != nil {
+		t.Errorf("expected a positive duration, 2 rows and no error, got %+v", event)
+	}
+	if got := event.Annotations["db.termination"]; got != "completed" {
+		t.Errorf("expected the event to carry the subsegment annotations, got %v", event.Annotations)
+	}
+
+	events = nil
+	if err := db.Exec("SELECT * FROM missing_table").Error; err == nil {
+		t.Fatal("expected the query to fail")
+	}
+	if len(events) != 1 {
+		t.Fatalf("expected one event, got %d", len(events))
+	}
+	if event := events[0]; event.Err == nil || event.Operation != "select" {
+		t.Errorf("expected the event to carry the query error, got %+v", event)
+	}
+}
+
+func TestQueryEventCallbackRecordedQuery(t *testing.T) {
+	var events []QueryEvent
+	var formatted int
+	db, _, rec := openTracedDB(t,
+		WithQueryEventCallback(func(event QueryEvent) {
+			events = append(events, event)
+		}),
+		WithQueryFormatter(func(query string) string {
+			formatted++
+			return query
+		}),
+		WithExcludeQueryVars(true),
+		WithSampledVars(1),
+	)
+
+	if err := db.Exec("SELECT ?", 42).Error; err != nil {
+		t.Fatalf("failed to execute query: %v", err)
+	}
+	if formatted != 1 {
+		t.Errorf("expected the query formatter to run once, got %d", formatted)
+	}
+	recorded, _ := metadata(rec.last(t), "db.query")
+	if len(events) != 1 || events[0].Query != recorded {
+		t.Errorf("expected the event query to match db.query %v, got %+v", recorded, events)
+	}
+}
@@ -0,0 +1,49 @@
+package gormxray
+
+import (
+	"context"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+// preloadCollectorKey is the context key under which a query with preloads shares its collector with the
+// preload sub-queries GORM issues on its behalf.
+type preloadCollectorKey struct {
+	namespace string
+}
+
+// preloadCollector gathers the queries of preload sub-queries so they can be recorded on the parent subsegment.
+type preloadCollector struct {
+	mu      sync.Mutex
+	queries []string
+}
+
+func (c *preloadCollector) add(query string) {
+	c.mu.Lock()
+	c.queries = append(c.queries, query)
+	c.mu.Unlock()
+}
+
+func (c *preloadCollector) list() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.queries...)
+}
+
+// preloadCollectorFrom returns the collector of the enclosing query if tx is a preload sub-query.
+func preloadCollectorFrom(ctx context.Context, namespace string) *preloadCollector {
+	collector, _ := ctx.Value(preloadCollectorKey{namespace}).(*preloadCollector)
+	return collector
+}
+
+// startPreloadCollection attaches a collector to the statement context when the query has preloads, so that the
+// preload sub-queries are recorded on this query's subsegment instead of as nested subsegments.
+func (p *Plugin) startPreloadCollection(tx *gorm.DB) {
+	if len(tx.Statement.Preloads) == 0 {
+		return
+	}
+	collector := &preloadCollector{}
+	tx.Statement.Context = context.WithValue(tx.Statement.Context, preloadCollectorKey{p.instanceKeyNamespace}, collector)
+	tx.InstanceSet(p.instanceKey("xray_preloads"), collector)
+}
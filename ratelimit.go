@@ -0,0 +1,44 @@
+package gormxray
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenBucket is a token bucket rate limiter holding up to one second's worth of tokens.
+type tokenBucket struct {
+	mu       sync.Mutex
+	rate     float64
+	capacity float64
+	tokens   float64
+	last     time.Time
+}
+
+func newTokenBucket(perSecond int) *tokenBucket {
+	return &tokenBucket{
+		rate:     float64(perSecond),
+		capacity: float64(perSecond),
+		tokens:   float64(perSecond),
+		last:     time.Now(),
+	}
+}
+
+// allow takes a token from the bucket, refilling it for the time elapsed since the last call. It reports false
+// when the bucket is exhausted.
+func (b *tokenBucket) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
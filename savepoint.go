@@ -0,0 +1,114 @@
+package gormxray
+
+import (
+	"regexp"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+// Savepoint statements issued by the dialectors for nested transactions.
+var (
+	savepointRegex        = regexp.MustCompile(`(?i)^\s*SAVEPOINT\s+(\S+)`)
+	releaseSavepointRegex = regexp.MustCompile(`(?i)^\s*(?:ROLLBACK\s+TO|RELEASE)(?:\s+SAVEPOINT)?\s+(\S+)`)
+	// nestedSavepointRegex matches the names db.Transaction gives the savepoints of nested transactions ("sp%p").
+	nestedSavepointRegex = regexp.MustCompile(`^sp0x[0-9a-f]+$`)
+)
+
+// savepoint is a savepoint active on a transaction. For the savepoints of nested db.Transaction calls, issuer is the
+// configuration of the session that created it; the nested transaction runs on a session with its own copy.
+type savepoint struct {
+	name   string
+	issuer *gorm.Config
+}
+
+// savepointTracker follows the savepoints created on each transaction, to tell which statements run inside a nested
+// transaction. GORM keeps no marker for nested transactions, so the tracker watches the SAVEPOINT, ROLLBACK TO and
+// RELEASE statements going through the plugin instead.
+type savepointTracker struct {
+	mu     sync.Mutex
+	active map[gorm.ConnPool][]savepoint
+}
+
+func newSavepointTracker() *savepointTracker {
+	return &savepointTracker{active: make(map[gorm.ConnPool][]savepoint)}
+}
+
+// openSavepoints returns the savepoints that are still active when cfg issues a statement. GORM doesn't release the savepoint
+// of a nested transaction that succeeded; a statement from the session that created it means the nested transaction
+// has returned, so its savepoint and those after it are over.
+func openSavepoints(names []savepoint, cfg *gorm.Config) []savepoint {
+	for i, sp := range names {
+		if sp.issuer == cfg {
+			return names[:i]
+		}
+	}
+	return names
+}
+
+// inSavepoint reports whether a savepoint was active on the statement's transaction when the statement ran.
+func (s *savepointTracker) inSavepoint(tx *gorm.DB) bool {
+	pool := pinnedConn(tx.Statement.ConnPool)
+	if pool == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(openSavepoints(s.active[pool], tx.Config)) > 0
+}
+
+// track updates the savepoints of the statement's transaction from the statement. It runs for every statement,
+// including those the plugin doesn't trace, so no SAVEPOINT, ROLLBACK TO or RELEASE is missed.
+func (s *savepointTracker) track(tx *gorm.DB) {
+	pool := pinnedConn(tx.Statement.ConnPool)
+	if pool == nil {
+		return
+	}
+	query := tx.Statement.SQL.String()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := openSavepoints(s.active[pool], tx.Config)
+	if tx.Error == nil {
+		if m := savepointRegex.FindStringSubmatch(query); m != nil {
+			sp := savepoint{name: m[1]}
+			if nestedSavepointRegex.MatchString(sp.name) {
+				sp.issuer = tx.Config
+			}
+			names = append(names, sp)
+		} else if m := releaseSavepointRegex.FindStringSubmatch(query); m != nil {
+			// Releasing or rolling back to a savepoint discards it and every savepoint created after it
+			for i := len(names) - 1; i >= 0; i-- {
+				if names[i].name == m[1] {
+					names = names[:i]
+					break
+				}
+			}
+		}
+	}
+
+	if len(names) == 0 {
+		delete(s.active, pool)
+	} else {
+		if _, ok := s.active[pool]; !ok && len(s.active) >= maxCachedConns {
+			s.active = make(map[gorm.ConnPool][]savepoint)
+		}
+		s.active[pool] = names
+	}
+}
+
+// release forgets the savepoints of the statement's transaction once GORM commits or rolls back the transaction it
+// started for the statement.
+func (s *savepointTracker) release(tx *gorm.DB) {
+	if _, ok := tx.InstanceGet("gorm:started_transaction"); !ok {
+		return
+	}
+	pool := pinnedConn(tx.Statement.ConnPool)
+	if pool == nil {
+		return
+	}
+	s.mu.Lock()
+	delete(s.active, pool)
+	s.mu.Unlock()
+}
@@ -0,0 +1,64 @@
+package gormxray
+
+import (
+	"context"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// searchPathRegex finds the search_path parameter of a key/value Postgres DSN, e.g. "host=db search_path=tenant".
+var searchPathRegex = regexp.MustCompile(`(?:^|\s)search_path=('[^']*'|\S+)`)
+
+// schemaKey marks a context carrying the schema set with ContextWithSchema.
+type schemaKey struct{}
+
+// ContextWithSchema returns a copy of ctx recording schema as the schema its queries run against, for
+// WithCaptureSchema. It takes precedence over the search_path configured in the DSN.
+func ContextWithSchema(ctx context.Context, schema string) context.Context {
+	return context.WithValue(ctx, schemaKey{}, schema)
+}
+
+// statementSchema returns the schema the statement runs against: the one set on its context with
+// ContextWithSchema, or else the search_path of the dialector's DSN. The server is never queried.
+func statementSchema(tx *gorm.DB) string {
+	if schema, ok := tx.Statement.Context.Value(schemaKey{}).(string); ok && schema != "" {
+		return schema
+	}
+	return schemaFromDSN(dialectorDSN(tx.Dialector))
+}
+
+// dialectorDSN reads the DSN a dialector was configured with, e.g. sqlite.Dialector.DSN or postgres.Config.DSN.
+func dialectorDSN(dialector gorm.Dialector) string {
+	v := reflect.Indirect(reflect.ValueOf(dialector))
+	if v.Kind() != reflect.Struct {
+		return ""
+	}
+	field, ok := v.Type().FieldByName("DSN")
+	if !ok {
+		return ""
+	}
+	// The DSN may be promoted from an embedded *Config, which can be nil
+	f, err := v.FieldByIndexErr(field.Index)
+	if err != nil || f.Kind() != reflect.String {
+		return ""
+	}
+	return f.String()
+}
+
+// schemaFromDSN extracts the search_path from a Postgres DSN in key/value or URL form.
+func schemaFromDSN(dsn string) string {
+	if strings.Contains(dsn, "://") {
+		if u, err := url.Parse(dsn); err == nil {
+			return u.Query().Get("search_path")
+		}
+		return ""
+	}
+	if m := searchPathRegex.FindStringSubmatch(dsn); m != nil {
+		return strings.Trim(m[1], "'")
+	}
+	return ""
+}
@@ -0,0 +1,80 @@
+package gormxray
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"gorm.io/gorm"
+)
+
+// statementStateKey is the instance key under which the before hook hands the statement's state to the after hook.
+const statementStateKey = "xray_state"
+
+// statementState is the per-statement state recorded by the before hook and consumed by the after hook. Keeping it in
+// a single struct costs one instance setting per statement instead of one per field.
+type statementState struct {
+	subsegment     *xray.Segment
+	parent         *xray.Segment
+	fallback       *xray.Segment
+	ownParent      bool
+	start          time.Time
+	deadlineBudget time.Duration
+	hasDeadline    bool
+	planCacheSize  int
+	hasPlanCache   bool
+	connsOpened    int64
+	hasConnsOpened bool
+	beforeOverhead time.Duration
+	txOutcome      string
+}
+
+// statementStatePool recycles statement states for plugins configured with WithSubsegmentPool.
+var statementStatePool = sync.Pool{
+	New: func() interface{} { return new(statementState) },
+}
+
+// newStatementState returns an empty statement state, taken from the pool if pooling is enabled.
+func (p *Plugin) newStatementState() *statementState {
+	if p.subsegmentPool {
+		return statementStatePool.Get().(*statementState)
+	}
+	return &statementState{}
+}
+
+// releaseStatementState detaches st from the statement, so a reused statement the before hook doesn't trace can't
+// pick up stale state. With pooling enabled, st is then reset and returned to the pool; the statement no longer
+// references it, and the after hook calls this last, once nothing else reads st.
+func (p *Plugin) releaseStatementState(tx *gorm.DB, st *statementState) {
+	tx.InstanceSet(p.instanceKey(statementStateKey), nil)
+	if p.subsegmentPool {
+		*st = statementState{}
+		statementStatePool.Put(st)
+	}
+}
+
+// statementStateOf returns the state the before hook recorded for the statement, or nil if it didn't trace it.
+func (p *Plugin) statementStateOf(tx *gorm.DB) *statementState {
+	val, ok := tx.InstanceGet(p.instanceKey(statementStateKey))
+	if !ok {
+		return nil
+	}
+	st, _ := val.(*statementState)
+	return st
+}
+
+// trackedParent returns the parent segment that per-parent state (N+1 runs, duplicate errors, once-per-parent
+// metadata) is kept for, or nil if there is none worth tracking. A fallback segment the plugin opened for the
+// statement only ever holds that one statement, so tracking it would only fill the stores with entries that are
+// never looked up again.
+func (st *statementState) trackedParent() *xray.Segment {
+	if st.ownParent {
+		return nil
+	}
+	return st.parent
+}
+
+// queryDuration returns the time elapsed since the before hook started the subsegment.
+func (st *statementState) queryDuration() time.Duration {
+	return time.Since(st.start)
+}
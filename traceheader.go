@@ -0,0 +1,138 @@
+package gormxray
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"gorm.io/gorm"
+)
+
+// TraceHeaderMode selects how WithTraceHeaderInjection passes the X-Ray trace header to the database.
+type TraceHeaderMode int
+
+const (
+	// TraceHeaderNone doesn't inject the trace header.
+	TraceHeaderNone TraceHeaderMode = iota
+	// TraceHeaderComment prefixes every executed statement with a /* X-Amzn-Trace-Id: ... */ comment. It is skipped
+	// when GORM's PrepareStmt mode is enabled, since every commented statement would be prepared and cached anew.
+	TraceHeaderComment
+	// TraceHeaderSessionVariable stores the trace header in a session variable before the statement runs. It is only
+	// applied on pinned connections (transactions and *sql.Conn) of the mysql and postgres dialectors, since on a
+	// pooled connection the variable could end up on a different connection than the statement.
+	TraceHeaderSessionVariable
+)
+
+// traceHeaderComment returns the SQL comment carrying seg's downstream trace header.
+func traceHeaderComment(seg *xray.Segment) string {
+	return fmt.Sprintf("/* X-Amzn-Trace-Id: %s */ ", seg.DownstreamHeader().String())
+}
+
+// traceHeaderSessionStatement returns the dialector-specific statement storing header in a session variable, or an
+// empty string if the engine isn't supported.
+func traceHeaderSessionStatement(tx *gorm.DB, header string) string {
+	switch tx.Dialector.Name() {
+	case "postgres":
+		return tx.Dialector.Explain("SELECT set_config('xray.trace_id', ?, false)", header)
+	case "mysql":
+		return tx.Dialector.Explain("SET @xray_trace_id = ?", header)
+	}
+	return ""
+}
+
+// injectTraceHeader passes seg's trace header to the database according to mode.
+func injectTraceHeader(tx *gorm.DB, seg *xray.Segment, mode TraceHeaderMode) {
+	switch mode {
+	case TraceHeaderComment:
+		if preparesStatements(tx.Statement.ConnPool) {
+			seg.AddMetadata("db.trace_header.skipped", "prepared statements")
+			return
+		}
+		tx.Statement.ConnPool = &commentedConnPool{ConnPool: tx.Statement.ConnPool, comment: traceHeaderComment(seg)}
+	case TraceHeaderSessionVariable:
+		conn := pinnedConn(tx.Statement.ConnPool)
+		if stmt := traceHeaderSessionStatement(tx, seg.DownstreamHeader().String()); conn != nil && stmt != "" {
+			if _, err := conn.ExecContext(tx.Statement.Context, stmt); err != nil {
+				seg.AddMetadata("db.trace_header.error", err.Error())
+			}
+		}
+	}
+}
+
+// preparesStatements reports whether pool caches a prepared statement per distinct query, as it does with
+// PrepareStmt. A per-query trace header comment would make every statement distinct and grow that cache without bound.
+func preparesStatements(pool gorm.ConnPool) bool {
+	switch pool.(type) {
+	case *gorm.PreparedStmtDB, *gorm.PreparedStmtTX:
+		return true
+	}
+	return false
+}
+
+// restoreConnPool undoes the comment injection of injectTraceHeader.
+func restoreConnPool(tx *gorm.DB) {
+	if pool, ok := tx.Statement.ConnPool.(*commentedConnPool); ok {
+		tx.Statement.ConnPool = pool.ConnPool
+	}
+}
+
+// commentedConnPool prefixes every statement with a comment before handing it to the wrapped pool.
+type commentedConnPool struct {
+	gorm.ConnPool
+	comment string
+}
+
+func (c *commentedConnPool) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	return c.ConnPool.PrepareContext(ctx, c.comment+query)
+}
+
+func (c *commentedConnPool) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return c.ConnPool.ExecContext(ctx, c.comment+query, args...)
+}
+
+func (c *commentedConnPool) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return c.ConnPool.QueryContext(ctx, c.comment+query, args...)
+}
+
+func (c *commentedConnPool) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return c.ConnPool.QueryRowContext(ctx, c.comment+query, args...)
+}
+
+// BeginTx starts a transaction on the wrapped pool whose statements carry the same comment.
+func (c *commentedConnPool) BeginTx(ctx context.Context, opts *sql.TxOptions) (gorm.ConnPool, error) {
+	var pool gorm.ConnPool
+	switch beginner := c.ConnPool.(type) {
+	case gorm.TxBeginner:
+		tx, err := beginner.BeginTx(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		pool = tx
+	case gorm.ConnPoolBeginner:
+		tx, err := beginner.BeginTx(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		pool = tx
+	default:
+		return nil, gorm.ErrInvalidTransaction
+	}
+	return &commentedConnPool{ConnPool: pool, comment: c.comment}, nil
+}
+
+// Commit commits the wrapped transaction. The pool is wrapped after GORM's default transaction has begun, so
+// committing it has to go through the wrapper.
+func (c *commentedConnPool) Commit() error {
+	if committer, ok := c.ConnPool.(gorm.TxCommitter); ok {
+		return committer.Commit()
+	}
+	return gorm.ErrInvalidTransaction
+}
+
+func (c *commentedConnPool) Rollback() error {
+	if committer, ok := c.ConnPool.(gorm.TxCommitter); ok {
+		return committer.Rollback()
+	}
+	return gorm.ErrInvalidTransaction
+}
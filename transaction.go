@@ -0,0 +1,36 @@
+package gormxray
+
+import (
+	"gorm.io/gorm"
+)
+
+// Outcomes of the default transaction GORM wraps creates, updates and deletes in, recorded as db.tx.outcome.
+const (
+	txOutcomeCommit   = "commit"
+	txOutcomeRollback = "rollback"
+)
+
+// transactionOutcome returns the hook run right after GORM committed or rolled back the statement's default
+// transaction. It fires the AfterCommit or AfterRollback hook and hands the outcome to the after hook. A failed commit
+// leaves its error on the statement and is reported as a rollback.
+func (p *Plugin) transactionOutcome() gormHookFunc {
+	return func(tx *gorm.DB) {
+		if _, ok := tx.InstanceGet("gorm:started_transaction"); !ok {
+			return
+		}
+
+		outcome := txOutcomeCommit
+		if tx.Error != nil {
+			outcome = txOutcomeRollback
+			if p.afterRollback != nil {
+				p.afterRollback(tx.Statement.Context, tx, tx.Error)
+			}
+		} else if p.afterCommit != nil {
+			p.afterCommit(tx.Statement.Context, tx)
+		}
+
+		if st := p.statementStateOf(tx); st != nil {
+			st.txOutcome = outcome
+		}
+	}
+}
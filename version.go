@@ -0,0 +1,66 @@
+package gormxray
+
+import (
+	"runtime/debug"
+	"sync"
+)
+
+// modulePath is the import path of this module, used to look up its version in the build info.
+const modulePath = "github.com/grahms/gormxray"
+
+// moduleVersion returns the version of the module at path as recorded in the binary's build info, "(devel)" when
+// it is the main module built from a checkout, or "unknown" if the build info isn't available.
+func moduleVersion(path string) string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	return buildInfoVersion(info, path)
+}
+
+// buildInfoVersion looks up the version of the module at path in info. A dependency replaced by a local directory
+// has no replacement version, so the version it replaced is reported instead, or "(devel)" if there is none.
+func buildInfoVersion(info *debug.BuildInfo, path string) string {
+	if info.Main.Path == path {
+		if info.Main.Version == "" {
+			return "(devel)"
+		}
+		return info.Main.Version
+	}
+	for _, dep := range info.Deps {
+		if dep.Path != path {
+			continue
+		}
+		if dep.Replace != nil && dep.Replace.Version != "" {
+			return dep.Replace.Version
+		}
+		if dep.Version == "" {
+			return "(devel)"
+		}
+		return dep.Version
+	}
+	return "unknown"
+}
+
+// segmentOnce remembers which parent segments have already seen an event.
+type segmentOnce struct {
+	mu   sync.Mutex
+	seen *parentStore[struct{}]
+}
+
+func newSegmentOnce() *segmentOnce {
+	return &segmentOnce{seen: newParentStore[struct{}]()}
+}
+
+// first reports whether this is the first call for the statement's parent segment. A parent that isn't tracked
+// holds no other statement, so it always sees the event first.
+func (o *segmentOnce) first(st *statementState) bool {
+	parent := st.trackedParent()
+	if parent == nil {
+		return st.parent != nil
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	_, seen := o.seen.get(parent)
+	return !seen
+}